@@ -4,10 +4,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/OpenSlides/openslides-go/datastore/cache/pendingmap"
 	"github.com/OpenSlides/openslides-go/datastore/dskey"
 	"github.com/OpenSlides/openslides-go/datastore/flow"
+	"github.com/OpenSlides/openslides-go/environment"
+)
+
+var (
+	envCacheMaxSize    = environment.NewVariable("CACHE_MAX_SIZE", "0", "Memory budget of the datastore cache in bytes. The units KB, MB and GB can be used. If the budget is exceeded, values that were not used recently are removed. 0 means unlimited.")
+	envCacheNilTTL     = environment.NewVariable("CACHE_NIL_TTL", "0", "Duration after which a cached value for a key, that does not exist, is fetched again. Can be set per collection like `10s,motion=1s`. 0 means forever.")
+	envCacheStaleAfter = environment.NewVariable("CACHE_STALE_AFTER", "0", "Duration after which a cached value is fetched again in the background. The old value is used until the new value arrives. Can be set per collection like `5m,meeting=1m`. 0 means never.")
 )
 
 // Cache stores the values to the datastore.
@@ -19,11 +33,31 @@ import (
 // the datastore. An existing key can have the value `nil` which means, that the
 // Cache knows, that the key does not exist in the datastore.
 //
+// A cache created with NewFromEnv can fetch values again after some time.
+// Values for keys that do not exist can have a TTL, so they are fetched again
+// when they are requested after the TTL. Stale values are returned but fetched
+// again in the background.
+//
 // A new Cache instance has to be created with newCache().
 type Cache struct {
 	data *pendingmap.PendingMap
 	flow flow.Flow
 
+	position atomic.Uint64
+
+	// resumeFrom is the position of a loaded snapshot.
+	resumeFrom atomic.Uint64
+
+	fetchMu sync.Mutex
+	fetches map[dskey.Key]*fetch
+
+	// flowCalls and flowDuration measure the requests to the flow.
+	flowCalls    atomic.Uint64
+	flowDuration atomic.Int64
+
+	nilTTL     collectionDurations
+	staleAfter collectionDurations
+
 	onlyCollectionField bool
 	collectionField     dskey.Key
 }
@@ -36,6 +70,131 @@ func New(flow flow.Flow) *Cache {
 	}
 }
 
+// NewFromEnv creates a cache that is configured with the environment
+// variables CACHE_MAX_SIZE, CACHE_NIL_TTL and CACHE_STALE_AFTER.
+func NewFromEnv(lookup environment.Environmenter, flow flow.Flow) (*Cache, error) {
+	maxSize, err := parseSize(envCacheMaxSize.Value(lookup))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", envCacheMaxSize.Key, err)
+	}
+
+	nilTTL, err := parseCollectionDurations(envCacheNilTTL.Value(lookup))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", envCacheNilTTL.Key, err)
+	}
+
+	staleAfter, err := parseCollectionDurations(envCacheStaleAfter.Value(lookup))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", envCacheStaleAfter.Key, err)
+	}
+
+	return &Cache{
+		data:       pendingmap.NewBounded(maxSize),
+		flow:       flow,
+		nilTTL:     nilTTL,
+		staleAfter: staleAfter,
+	}, nil
+}
+
+// parseSize parses a size in bytes with an optional unit.
+func parseSize(value string) (int, error) {
+	units := []struct {
+		suffix string
+		factor int
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	value = strings.ToUpper(strings.TrimSpace(value))
+	factor := 1
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value = strings.TrimSpace(number)
+			factor = unit.factor
+			break
+		}
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %s", value)
+	}
+
+	return size * factor, nil
+}
+
+// collectionDurations is a duration with optional values for some
+// collections. A duration of 0 means, that the feature is disabled.
+type collectionDurations struct {
+	all          time.Duration
+	byCollection map[string]time.Duration
+}
+
+// parseCollectionDurations parses a value like `10s,motion=1s`. The entry
+// without a collection is used for all other collections.
+func parseCollectionDurations(value string) (collectionDurations, error) {
+	var durations collectionDurations
+	for entry := range strings.SplitSeq(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		collection, rawDuration, hasCollection := strings.Cut(entry, "=")
+		if !hasCollection {
+			rawDuration = collection
+		}
+
+		duration, err := environment.ParseDuration(strings.TrimSpace(rawDuration))
+		if err != nil {
+			return collectionDurations{}, fmt.Errorf("invalid duration in %s: %w", entry, err)
+		}
+
+		if !hasCollection {
+			durations.all = duration
+			continue
+		}
+
+		collection = strings.TrimSpace(collection)
+		if !dskey.ValidateCollectionField(collection, "id") {
+			return collectionDurations{}, fmt.Errorf("unknown collection %s", collection)
+		}
+
+		if durations.byCollection == nil {
+			durations.byCollection = make(map[string]time.Duration)
+		}
+		durations.byCollection[collection] = duration
+	}
+	return durations, nil
+}
+
+// enabled returns true, if there is a duration for any collection.
+func (d collectionDurations) enabled() bool {
+	if d.all > 0 {
+		return true
+	}
+
+	for _, duration := range d.byCollection {
+		if duration > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// exceeded returns true, if the duration for the collection of the key is not
+// 0 and smaller then age.
+func (d collectionDurations) exceeded(key dskey.Key, age time.Duration) bool {
+	duration, ok := d.byCollection[key.Collection()]
+	if !ok {
+		duration = d.all
+	}
+	return duration > 0 && age > duration
+}
+
 // Get returns the values for a list of keys. If one or more keys do not exist
 // in the cache, then the missing values are fetched. If this method is called
 // more then once at the same time, only the first call fetches the result, the
@@ -49,76 +208,334 @@ func New(flow flow.Flow) *Cache {
 // If a value can not be fetched from the flow, it is saved in the cache as nil
 // to prevent a second call for the same key.
 //
-// If the context is done, GetOrSet returns. But the call to the flow is not stopped.
-// Other calls to GetOrSet may wait for its result.
+// If the context is done, Get returns. The call to the flow is only canceled,
+// if no other call to Get waits for its result.
+//
+// If the fetched values are bigger then the memory budget, they are returned
+// even when they could not be kept in the cache.
+//
+// If the flow returns a flow.DegradedError, the replaced values are not cached.
+// They are returned together with a flow.DegradedError, that contains the
+// requested keys with replaced values.
 //
 // Possible Errors: context.Canceled or context.DeadlineExeeded or the return
 // value from hte set func.
 func (c *Cache) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
-	// Blocks until all missing (but not pending) keys are fetched.
-	//
-	// After this call, all keys are either pending (from another parallel call)
-	// or in the c.data.
-	if err := c.fetchMissing(ctx, keys); err != nil {
-		return nil, fmt.Errorf("fetching missing keys: %w", err)
+	// A key can be unmarked, while it is fetched, for example by an
+	// invalidation. In this case, it is fetched again.
+	const maxAttempts = 3
+
+	for attempt := 1; ; attempt++ {
+		got, err := c.get(ctx, keys)
+		var degraded *flow.DegradedError
+		if err != nil && !errors.As(err, &degraded) {
+			if errors.Is(err, pendingmap.ErrNotExist) {
+				if attempt < maxAttempts {
+					continue
+				}
+				return nil, fmt.Errorf("fetching data in a parallel call failed")
+			}
+			return nil, err
+		}
+
+		c.revalidate(keys)
+		return got, err
+	}
+}
+
+// get fetches the missing keys and waits until all keys are not pending
+// anymore.
+//
+// While it waits, it counts as a waiter for all fetches of its keys.
+func (c *Cache) get(ctx context.Context, keys []dskey.Key) (map[dskey.Key][]byte, error) {
+	// After this call, all keys are either pending (from this or another
+	// parallel call) or in the c.data. The caller is already a waiter of its
+	// own fetch.
+	ownFetch := c.fetchMissing(ctx, keys)
+
+	fetches := c.joinFetches(keys, ownFetch)
+	defer c.leaveFetches(fetches)
+
+	if ownFetch != nil {
+		select {
+		case <-ownFetch.done:
+			if ownFetch.err != nil {
+				return nil, fmt.Errorf("fetching missing keys: %w", ownFetch.err)
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for fetch missing: %w", ctx.Err())
+		}
 	}
 
-	got, err := c.data.Get(ctx, keys...)
-	if err != nil {
-		if errors.Is(err, pendingmap.ErrNotExist) {
-			return nil, fmt.Errorf("fetching data in a parallel call failed")
+	values, err := c.data.Get(ctx, keys...)
+	if errors.Is(err, pendingmap.ErrNotExist) {
+		// If the values are bigger then the memory budget, they can be
+		// evicted, before they are read. In this case, the values of the
+		// fetches are returned without caching them.
+		return c.fetchedValues(ctx, keys, fetches)
+	}
+	return values, err
+}
+
+// fetchedValues returns the values of the keys from the cache or from the
+// given fetches.
+//
+// Returns pendingmap.ErrNotExist, if a key is neither in the cache nor was set
+// by one of the fetches. If values were replaced by the flow, they are returned
+// with a flow.DegradedError.
+func (c *Cache) fetchedValues(ctx context.Context, keys []dskey.Key, fetches []*fetch) (map[dskey.Key][]byte, error) {
+	values := c.data.Peek(keys...)
+	var degraded flow.DegradedError
+	for _, f := range fetches {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for fetch: %w", ctx.Err())
+		}
+
+		for _, key := range keys {
+			value, ok := f.values[key]
+			if !ok {
+				continue
+			}
+
+			if _, exists := values[key]; exists {
+				continue
+			}
+			values[key] = value
+
+			if f.degraded != nil && slices.Contains(f.degraded.Keys, key) {
+				degraded.Keys = append(degraded.Keys, key)
+				degraded.Err = f.degraded.Err
+			}
 		}
-		return nil, err
 	}
 
-	return got, nil
+	if len(values) != len(keys) {
+		return nil, pendingmap.ErrNotExist
+	}
+
+	if len(degraded.Keys) > 0 {
+		return values, &degraded
+	}
+	return values, nil
 }
 
-// fetchMissing loads all keys, that are currently not in the cache.
+// fetchMissing starts to load all keys, that are currently not in the cache.
+// The caller is registered as waiter of the fetch and has to leave it with
+// leaveFetches.
 //
-// Possible Errors: context.Canceled or context.DeadlineExeeded.
-func (c *Cache) fetchMissing(ctx context.Context, keys []dskey.Key) error {
+// Returns nil, if there are no missing keys.
+func (c *Cache) fetchMissing(ctx context.Context, keys []dskey.Key) *fetch {
+	if c.nilTTL.enabled() {
+		c.data.Expire(func(key dskey.Key, value []byte, age time.Duration) bool {
+			return value == nil && c.nilTTL.exceeded(key, age)
+		}, keys...)
+	}
+
 	missingKeys := c.data.MarkPending(keys...)
 
 	if len(missingKeys) == 0 {
 		return nil
 	}
 
-	// Fetch missing keys in the background. Do not stop the fetching. Even
-	// when the context is done. Other calls could also request it.
-	errChan := make(chan error, 1)
+	// The fetch does not use the cancel of the context. It is only canceled,
+	// when there is no caller waiting for it.
+	return c.startFetch(context.WithoutCancel(ctx), missingKeys, false)
+}
+
+// fetch is a running request to the flow for keys, that are marked as
+// pending.
+type fetch struct {
+	// waiters is the amount of callers, that wait for the fetch. It is
+	// protected by Cache.fetchMu.
+	waiters int
+	cancel  context.CancelFunc
+
+	// done is closed, when the fetch is finished. Afterwards, err, values
+	// and degraded can be read. values are the fetched values, that were set
+	// in the cache, and the replaced values, that are listed in degraded.
+	done     chan struct{}
+	err      error
+	values   map[dskey.Key][]byte
+	degraded *flow.DegradedError
+}
+
+// startFetch fetches pending keys in the background.
+//
+// The fetch starts with one waiter. If pinned is false, this is the caller,
+// that has to leave the fetch with leaveFetches. If pinned is true, the waiter
+// never leaves, so the fetch is not canceled, when all other waiters are gone.
+//
+// The waiter is registered together with the fetch. So a parallel caller,
+// that joins and leaves the fetch, can not cancel it.
+func (c *Cache) startFetch(ctx context.Context, pendingKeys []dskey.Key, pinned bool) *fetch {
+	ctx, cancel := context.WithCancel(ctx)
+	f := &fetch{
+		waiters: 1,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	c.fetchMu.Lock()
+	if c.fetches == nil {
+		c.fetches = make(map[dskey.Key]*fetch)
+	}
+	for _, key := range pendingKeys {
+		c.fetches[key] = f
+	}
+	c.fetchMu.Unlock()
+
 	go func() {
-		data, err := c.flow.Get(context.WithoutCancel(ctx), missingKeys...)
+		defer cancel()
+
+		values, degraded, err := c.fetchPending(ctx, pendingKeys)
 		if err != nil {
-			c.data.UnMarkPending(missingKeys...)
-			errChan <- fmt.Errorf("getting data from flow: %w", err)
-			return
+			err = fmt.Errorf("fetching key: %w", err)
+		}
+
+		c.fetchMu.Lock()
+		for _, key := range pendingKeys {
+			if c.fetches[key] == f {
+				delete(c.fetches, key)
+			}
 		}
+		c.fetchMu.Unlock()
 
-		if len(data) != len(missingKeys) {
-			// A getter has to return the same amount of values, as keys where
-			// requested. So this check should not be necessary. But there will
-			// be very strange behaviour, if the getter has a but.
-			c.data.UnMarkPending(missingKeys...)
-			errChan <- fmt.Errorf("got %d keys from getter, but requested %d", len(data), len(missingKeys))
+		f.err = err
+		f.values = values
+		f.degraded = degraded
+		close(f.done)
+	}()
+
+	return f
+}
+
+// joinFetches registers the caller as waiter for all running fetches of the
+// keys.
+//
+// ownFetch is a fetch, for which the caller is already a waiter. It can be
+// nil. If not, it is part of the returned fetches.
+func (c *Cache) joinFetches(keys []dskey.Key, ownFetch *fetch) []*fetch {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	var joined []*fetch
+	if ownFetch != nil {
+		joined = append(joined, ownFetch)
+	}
+
+	for _, key := range keys {
+		f := c.fetches[key]
+		if f == nil || slices.Contains(joined, f) {
+			continue
+		}
+
+		f.waiters++
+		joined = append(joined, f)
+	}
+	return joined
+}
+
+// leaveFetches unregisters the caller as waiter. Fetches without waiters are
+// canceled.
+func (c *Cache) leaveFetches(fetches []*fetch) {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	for _, f := range fetches {
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+		}
+	}
+}
+
+// revalidate fetches keys in the background, that are older then the
+// configured stale duration.
+//
+// Errors are ignored. The keys are fetched again with the next call.
+func (c *Cache) revalidate(keys []dskey.Key) {
+	if !c.staleAfter.enabled() {
+		return
+	}
+
+	staleKeys := c.data.MarkRefreshing(func(key dskey.Key, _ []byte, age time.Duration) bool {
+		return c.staleAfter.exceeded(key, age)
+	}, keys...)
+
+	if len(staleKeys) == 0 {
+		return
+	}
+
+	go func() {
+		data, err := c.flowGet(context.Background(), staleKeys)
+		if err != nil {
+			c.data.UnMarkRefreshing(staleKeys...)
 			return
 		}
 
-		c.data.SetIfPending(data)
+		c.data.SetIfRefreshing(data)
+		c.data.UnMarkRefreshing(staleKeys...)
+	}()
+}
 
-		errChan <- nil
+// flowGet fetches keys from the flow and measures the duration.
+func (c *Cache) flowGet(ctx context.Context, keys []dskey.Key) (map[dskey.Key][]byte, error) {
+	start := time.Now()
+	defer func() {
+		c.flowCalls.Add(1)
+		c.flowDuration.Add(int64(time.Since(start)))
 	}()
 
-	select {
-	case err := <-errChan:
-		if err != nil {
-			return fmt.Errorf("fetching key: %w", err)
+	return c.flow.Get(ctx, keys...)
+}
+
+// fetchPending fetches keys, that are marked as pending, from the flow.
+//
+// If the fetching fails, the keys are unmarked. Returns the values, that were
+// set in the cache.
+//
+// If the flow returns a flow.DegradedError, the replaced values are not set in
+// the cache, but they are returned together with the error.
+func (c *Cache) fetchPending(ctx context.Context, pendingKeys []dskey.Key) (map[dskey.Key][]byte, *flow.DegradedError, error) {
+	data, err := c.flowGet(ctx, pendingKeys)
+	var degraded *flow.DegradedError
+	if err != nil && !errors.As(err, &degraded) {
+		c.data.UnMarkPending(pendingKeys...)
+		return nil, nil, fmt.Errorf("getting data from flow: %w", err)
+	}
+
+	if len(data) != len(pendingKeys) {
+		// A getter has to return the same amount of values, as keys where
+		// requested. So this check should not be necessary. But there will
+		// be very strange behaviour, if the getter has a but.
+		c.data.UnMarkPending(pendingKeys...)
+		return nil, nil, fmt.Errorf("got %d keys from getter, but requested %d", len(data), len(pendingKeys))
+	}
+
+	if degraded == nil {
+		return c.data.SetIfPending(data), nil, nil
+	}
+
+	replaced := make(map[dskey.Key][]byte, len(degraded.Keys))
+	for _, key := range degraded.Keys {
+		if value, ok := data[key]; ok {
+			replaced[key] = value
+		}
+	}
+
+	cached := make(map[dskey.Key][]byte, len(data)-len(replaced))
+	for key, value := range data {
+		if _, ok := replaced[key]; !ok {
+			cached[key] = value
 		}
-	case <-ctx.Done():
-		return fmt.Errorf("waiting for fetch missing: %w", ctx.Err())
 	}
 
-	return nil
+	values := c.data.SetIfPending(cached)
+	c.data.UnMarkPending(degraded.Keys...)
+	maps.Copy(values, replaced)
+	return values, degraded, nil
 }
 
 // Update gets values from the flow to update the cached values.
@@ -127,17 +544,66 @@ func (c *Cache) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte,
 		updateFn = func(m map[dskey.Key][]byte, err error) {}
 	}
 
-	c.flow.Update(ctx, func(data map[dskey.Key][]byte, err error) {
+	c.UpdateWithPosition(ctx, func(_ uint64, data map[dskey.Key][]byte, err error) {
+		updateFn(data, err)
+	})
+}
+
+// UpdateWithPosition is like Update, but also returns the position of each
+// update.
+//
+// If the flow reports flow.ErrMissedUpdates, the cache is reset.
+//
+// If a snapshot was loaded, the changes since the snapshot are sent first.
+//
+// The position is always 0, if the flow does not implement
+// flow.UpdaterWithPosition.
+func (c *Cache) UpdateWithPosition(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	if updateFn == nil {
+		updateFn = func(uint64, map[dskey.Key][]byte, error) {}
+	}
+
+	handleUpdate := func(position uint64, data map[dskey.Key][]byte, err error) {
 		if err != nil {
-			updateFn(nil, err)
+			if errors.Is(err, flow.ErrMissedUpdates) {
+				c.data.Reset()
+			}
+			updateFn(0, nil, err)
 			return
 		}
 
 		c.data.SetIfPendingOrExists(data)
-		updateFn(data, nil)
+		if position != 0 {
+			c.position.Store(position)
+		}
+		updateFn(position, data, nil)
+	}
+
+	if resumer, ok := c.flow.(flow.Resumer); ok {
+		if from := c.resumeFrom.Swap(0); from != 0 {
+			resumer.UpdateFromPosition(ctx, from, handleUpdate)
+			return
+		}
+	}
+
+	if positionFlow, ok := c.flow.(flow.UpdaterWithPosition); ok {
+		positionFlow.UpdateWithPosition(ctx, handleUpdate)
+		return
+	}
+
+	c.flow.Update(ctx, func(data map[dskey.Key][]byte, err error) {
+		handleUpdate(0, data, err)
 	})
 }
 
+// Position returns the position of the last update, that was written to the
+// cache.
+//
+// Returns 0, if there was no update or the flow does not support positions.
+func (c *Cache) Position() uint64 {
+	return c.position.Load()
+}
+
 // Len returns the amount of keys in the cache.
 func (c *Cache) Len() int {
 	return c.data.Len()
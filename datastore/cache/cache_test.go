@@ -2,8 +2,10 @@ package cache_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,6 +13,7 @@ import (
 	"github.com/OpenSlides/openslides-go/datastore/dskey"
 	"github.com/OpenSlides/openslides-go/datastore/dsmock"
 	"github.com/OpenSlides/openslides-go/datastore/flow"
+	"github.com/OpenSlides/openslides-go/environment"
 )
 
 func TestCache_call_Get_returns_the_value_from_flow(t *testing.T) {
@@ -284,3 +287,464 @@ func TestCache_flow_returns_null_should_return_nil(t *testing.T) {
 		t.Errorf("Got %v, expected %v", got, expect)
 	}
 }
+
+type positionUpdate struct {
+	position uint64
+	err      error
+}
+
+type positionFlow struct {
+	*dsmock.Flow
+	ch chan positionUpdate
+}
+
+func (f positionFlow) UpdateWithPosition(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	for {
+		select {
+		case update := <-f.ch:
+			if update.err != nil {
+				updateFn(0, nil, update.err)
+				continue
+			}
+			updateFn(update.position, map[dskey.Key][]byte{}, nil)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func TestCache_Update_saves_the_position_from_the_flow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := positionFlow{
+		Flow: dsmock.NewFlow(dsmock.YAMLData(``)),
+		ch:   make(chan positionUpdate),
+	}
+	c := cache.New(ds)
+
+	if got := c.Position(); got != 0 {
+		t.Errorf("Position() before update == %d, expected 0", got)
+	}
+
+	received := make(chan uint64, 1)
+	go c.UpdateWithPosition(ctx, func(position uint64, _ map[dskey.Key][]byte, err error) {
+		if err != nil {
+			t.Errorf("Update: %v", err)
+		}
+		received <- position
+	})
+
+	ds.ch <- positionUpdate{position: 42}
+
+	if got := <-received; got != 42 {
+		t.Errorf("UpdateWithPosition called with position %d, expected 42", got)
+	}
+
+	if got := c.Position(); got != 42 {
+		t.Errorf("Position() == %d, expected 42", got)
+	}
+}
+
+func TestCache_Update_with_missed_updates_resets_the_cache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := positionFlow{
+		Flow: dsmock.NewFlow(dsmock.YAMLData(`---
+		user/1/username: value
+		`)),
+		ch: make(chan positionUpdate),
+	}
+	myKey := dskey.MustKey("user/1/username")
+	c := cache.New(ds)
+
+	if _, err := c.Get(ctx, myKey); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	received := make(chan error, 1)
+	go c.Update(ctx, func(_ map[dskey.Key][]byte, err error) {
+		received <- err
+	})
+
+	ds.ch <- positionUpdate{err: fmt.Errorf("connection lost: %w", flow.ErrMissedUpdates)}
+
+	if err := <-received; !errors.Is(err, flow.ErrMissedUpdates) {
+		t.Errorf("Update called with error %v, expected %v", err, flow.ErrMissedUpdates)
+	}
+
+	if got := c.Len(); got != 0 {
+		t.Errorf("Len() == %d after missed updates, expected 0", got)
+	}
+}
+
+func TestCache_NewFromEnv_refetches_evicted_keys(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: value
+		user/2/username: value
+		`),
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	myKey1 := dskey.MustKey("user/1/username")
+	myKey2 := dskey.MustKey("user/2/username")
+
+	// The budget is big enough for one key.
+	c, err := cache.NewFromEnv(environment.ForTests{"CACHE_MAX_SIZE": "100B"}, ds)
+	if err != nil {
+		t.Fatalf("NewFromEnv: %v", err)
+	}
+
+	for _, key := range []dskey.Key{myKey1, myKey2, myKey1} {
+		if _, err := c.Get(ctx, key); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+	}
+
+	counter := ds.Middlewares()[0].(*dsmock.Counter)
+	expect := [][]dskey.Key{{myKey1}, {myKey2}, {myKey1}}
+	if got := counter.Requests(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got %v, expect %v", got, expect)
+	}
+
+	if got := c.Stats().Evictions; got != 2 {
+		t.Errorf("got %d evictions, expected 2", got)
+	}
+}
+
+func TestCache_NewFromEnv_response_bigger_then_budget(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: value1
+		user/2/username: value2
+		user/3/username: value3
+		`),
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	keys := []dskey.Key{
+		dskey.MustKey("user/1/username"),
+		dskey.MustKey("user/2/username"),
+		dskey.MustKey("user/3/username"),
+	}
+
+	// The budget is to small for all three keys.
+	c, err := cache.NewFromEnv(environment.ForTests{"CACHE_MAX_SIZE": "150B"}, ds)
+	if err != nil {
+		t.Fatalf("NewFromEnv: %v", err)
+	}
+
+	got, err := c.Get(ctx, keys...)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	expect := map[dskey.Key][]byte{
+		keys[0]: []byte(`"value1"`),
+		keys[1]: []byte(`"value2"`),
+		keys[2]: []byte(`"value3"`),
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got %v, expected %v", got, expect)
+	}
+
+	counter := ds.Middlewares()[0].(*dsmock.Counter)
+	if got := counter.Count(); got != 1 {
+		t.Errorf("got %d requests, expected 1", got)
+	}
+}
+
+func TestCache_NewFromEnv_with_invalid_size(t *testing.T) {
+	for _, size := range []string{"many", "-1", "5TB"} {
+		if _, err := cache.NewFromEnv(environment.ForTests{"CACHE_MAX_SIZE": size}, nil); err == nil {
+			t.Errorf("NewFromEnv with size %s returned no error", size)
+		}
+	}
+}
+
+func TestCache_NewFromEnv_refetches_nil_values_after_ttl(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(
+		nil,
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	myKey := dskey.MustKey("user/1/username")
+
+	c, err := cache.NewFromEnv(environment.ForTests{"CACHE_NIL_TTL": "1h,user=10ms"}, ds)
+	if err != nil {
+		t.Fatalf("NewFromEnv: %v", err)
+	}
+
+	for range 2 {
+		if _, err := c.Get(ctx, myKey); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+	}
+
+	counter := ds.Middlewares()[0].(*dsmock.Counter)
+	if got := counter.Count(); got != 1 {
+		t.Errorf("got %d requests before the ttl, expected 1", got)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, err := c.Get(ctx, myKey); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if got := counter.Count(); got != 2 {
+		t.Errorf("got %d requests after the ttl, expected 2", got)
+	}
+}
+
+func TestCache_NewFromEnv_revalidates_stale_values_in_the_background(t *testing.T) {
+	ctx := context.Background()
+
+	waiter := make(chan error, 1)
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: hugo
+		`),
+		dsmock.NewWait(waiter),
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	myKey := dskey.MustKey("user/1/username")
+
+	c, err := cache.NewFromEnv(environment.ForTests{"CACHE_STALE_AFTER": "10ms"}, ds)
+	if err != nil {
+		t.Fatalf("NewFromEnv: %v", err)
+	}
+
+	waiter <- nil
+	if _, err := c.Get(ctx, myKey); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The flow blocks, but the stale value is returned.
+	got, err := c.Get(ctx, myKey)
+	if err != nil {
+		t.Fatalf("Get with stale value: %v", err)
+	}
+
+	if string(got[myKey]) != `"hugo"` {
+		t.Errorf("got %s, expected the stale value", got[myKey])
+	}
+
+	waiter <- nil
+
+	counter := ds.Middlewares()[1].(*dsmock.Counter)
+	for range 100 {
+		if counter.Count() == 2 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("got %d requests, expected the stale value to be fetched again", counter.Count())
+}
+
+func TestCache_NewFromEnv_with_invalid_durations(t *testing.T) {
+	for _, env := range []environment.ForTests{
+		{"CACHE_NIL_TTL": "soon"},
+		{"CACHE_NIL_TTL": "unknown_collection=1s"},
+		{"CACHE_STALE_AFTER": "user=later"},
+	} {
+		if _, err := cache.NewFromEnv(env, nil); err == nil {
+			t.Errorf("NewFromEnv with %v returned no error", env)
+		}
+	}
+}
+
+// blockingGetter blocks until the context is done. Afterwards it closes
+// canceled.
+type blockingGetter struct {
+	canceled chan struct{}
+}
+
+func (g blockingGetter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	<-ctx.Done()
+	close(g.canceled)
+	return nil, ctx.Err()
+}
+
+func TestCache_Get_cancels_the_flow_when_nobody_waits(t *testing.T) {
+	canceled := make(chan struct{})
+	ds := dsmock.NewFlow(nil, func(flow.Getter) flow.Getter {
+		return blockingGetter{canceled: canceled}
+	})
+	c := cache.New(ds)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := c.Get(ctx, dskey.MustKey("user/1/username")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Errorf("flow was not canceled")
+	}
+}
+
+func TestCache_Get_does_not_cancel_the_flow_when_another_caller_waits(t *testing.T) {
+	waiter := make(chan error, 1)
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: hugo
+		`),
+		dsmock.NewWait(waiter),
+	)
+	myKey := dskey.MustKey("user/1/username")
+	c := cache.New(ds)
+
+	firstCtx, firstCancel := context.WithCancel(context.Background())
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := c.Get(firstCtx, myKey)
+		firstDone <- err
+	}()
+
+	// Make sure, the first call has started the fetch.
+	time.Sleep(10 * time.Millisecond)
+
+	secondDone := make(chan error, 1)
+	go func() {
+		_, err := c.Get(context.Background(), myKey)
+		secondDone <- err
+	}()
+
+	// Make sure, the second call waits for the fetch.
+	time.Sleep(10 * time.Millisecond)
+
+	firstCancel()
+	if err := <-firstDone; !errors.Is(err, context.Canceled) {
+		t.Errorf("first Get returned %v, expected %v", err, context.Canceled)
+	}
+
+	waiter <- nil
+
+	select {
+	case err := <-secondDone:
+		if err != nil {
+			t.Errorf("second Get: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("second Get did not return")
+	}
+}
+
+// hookGetter calls hook before it calls the getter.
+type hookGetter struct {
+	getter flow.Getter
+	hook   func(ctx context.Context)
+}
+
+func (g hookGetter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	g.hook(ctx)
+	return g.getter.Get(ctx, keys...)
+}
+
+func TestCache_Get_short_caller_does_not_cancel_the_fetch_of_the_owner(t *testing.T) {
+	myKey := dskey.MustKey("user/1/username")
+
+	var c *cache.Cache
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: hugo
+		`),
+		func(in flow.Getter) flow.Getter {
+			return hookGetter{getter: in, hook: func(fetchCtx context.Context) {
+				// A caller with a done context joins and leaves the fetch,
+				// while it runs.
+				shortCtx, cancel := context.WithCancel(context.Background())
+				cancel()
+				c.Get(shortCtx, myKey)
+
+				if fetchCtx.Err() != nil {
+					t.Errorf("fetch was canceled by the short caller")
+				}
+			}}
+		},
+	)
+	c = cache.New(ds)
+
+	got, err := c.Get(context.Background(), myKey)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if string(got[myKey]) != `"hugo"` {
+		t.Errorf("Get returned %s, expected \"hugo\"", got[myKey])
+	}
+}
+
+// switchGetter fails, while broken is true.
+type switchGetter struct {
+	getter flow.Getter
+	broken atomic.Bool
+}
+
+func (g *switchGetter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	if g.broken.Load() {
+		return nil, errors.New("getter is broken")
+	}
+	return g.getter.Get(ctx, keys...)
+}
+
+func TestCache_Get_does_not_cache_replaced_values_of_a_degraded_flow(t *testing.T) {
+	ctx := context.Background()
+
+	voteKey := dskey.MustKey("poll/1/live_votes")
+	userKey := dskey.MustKey("user/1/username")
+
+	var voteGetter *switchGetter
+	voteFlow := dsmock.NewFlow(
+		dsmock.YAMLData(`poll/1/live_votes: votes`),
+		func(in flow.Getter) flow.Getter {
+			voteGetter = &switchGetter{getter: in}
+			return voteGetter
+		},
+	)
+	voteGetter.broken.Store(true)
+
+	combined, err := flow.CombineSources(
+		flow.Source{Flow: dsmock.NewFlow(dsmock.YAMLData(`user/1/username: hugo`))},
+		map[string]flow.Source{"poll/live_votes": {Flow: voteFlow, Policy: flow.PolicyNil}},
+	)
+	if err != nil {
+		t.Fatalf("CombineSources: %v", err)
+	}
+	c := cache.New(combined)
+
+	got, err := c.Get(ctx, voteKey, userKey)
+	var degraded *flow.DegradedError
+	if !errors.As(err, &degraded) {
+		t.Fatalf("Get returned error %v, expected a DegradedError", err)
+	}
+
+	if len(degraded.Keys) != 1 || degraded.Keys[0] != voteKey {
+		t.Errorf("DegradedError has keys %v, expected [%s]", degraded.Keys, voteKey)
+	}
+
+	if got[voteKey] != nil || string(got[userKey]) != `"hugo"` {
+		t.Errorf("Get with broken source returned %v", got)
+	}
+
+	voteGetter.broken.Store(false)
+	got, err = c.Get(ctx, voteKey)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if string(got[voteKey]) != `"votes"` {
+		t.Errorf("Get after the source recovered returned %s, expected \"votes\"", got[voteKey])
+	}
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/metagen"
+	"github.com/OpenSlides/openslides-go/set"
+)
+
+// meetingCollections are all collections, that belong to a meeting. They have
+// a field meeting_id.
+var meetingCollections = func() set.Set[string] {
+	collections := set.New[string]()
+	for collectionField, target := range metagen.RelationFields {
+		collection, field, _ := strings.Cut(collectionField, "/")
+		if field == "meeting_id" && strings.HasPrefix(target, "meeting/") {
+			collections.Add(collection)
+		}
+	}
+	return collections
+}()
+
+// InvalidateCollection removes all keys of a collection from the cache.
+//
+// The keys are fetched again, when they are requested the next time.
+func (c *Cache) InvalidateCollection(collection string) error {
+	if !dskey.ValidateCollectionField(collection, "id") {
+		return fmt.Errorf("unknown collection %s", collection)
+	}
+
+	c.data.Remove(func(key dskey.Key) bool {
+		return key.Collection() == collection
+	})
+	return nil
+}
+
+// InvalidateFQID removes all keys of one object from the cache.
+//
+// The fqid has the form collection/id.
+func (c *Cache) InvalidateFQID(fqid string) error {
+	idKey, err := dskey.FromString(fqid + "/id")
+	if err != nil {
+		return fmt.Errorf("invalid fqid %s: %w", fqid, err)
+	}
+
+	c.data.Remove(func(key dskey.Key) bool {
+		return key.IDField() == idKey
+	})
+	return nil
+}
+
+// InvalidateMeeting removes the meeting and all objects of the meeting from the
+// cache.
+//
+// An object belongs to the meeting, if its collection has the field
+// meeting_id with the id of the meeting. If the meeting_id of a cached object
+// is not in the cache, it is fetched from the flow without caching it.
+func (c *Cache) InvalidateMeeting(ctx context.Context, meetingID int) error {
+	meetingIDKeys := set.New[dskey.Key]()
+	for _, key := range c.data.Keys() {
+		if meetingCollections.Has(key.Collection()) {
+			meetingIDKey, err := dskey.FromParts(key.Collection(), key.ID(), "meeting_id")
+			if err != nil {
+				return fmt.Errorf("building meeting_id key for %s: %w", key, err)
+			}
+			meetingIDKeys.Add(meetingIDKey)
+		}
+	}
+
+	// A cached value of nil could be outdated, if the object was created
+	// afterwards. So only existing values are used.
+	keys := meetingIDKeys.List()
+	values := c.data.Peek(keys...)
+	var missing []dskey.Key
+	for _, key := range keys {
+		if values[key] == nil {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) > 0 {
+		fetched, err := c.flowGet(ctx, missing)
+		if err != nil {
+			return fmt.Errorf("fetching meeting ids: %w", err)
+		}
+
+		for key, value := range fetched {
+			values[key] = value
+		}
+	}
+
+	meetingObjects := set.New[dskey.Key]()
+	for key, value := range values {
+		if value == nil {
+			continue
+		}
+
+		id, err := strconv.Atoi(string(value))
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", key, value)
+		}
+
+		if id == meetingID {
+			meetingObjects.Add(key.IDField())
+		}
+	}
+
+	meetingKey, err := dskey.FromParts("meeting", meetingID, "id")
+	if err != nil {
+		return fmt.Errorf("invalid meeting id %d: %w", meetingID, err)
+	}
+	meetingObjects.Add(meetingKey)
+
+	c.data.Remove(func(key dskey.Key) bool {
+		return meetingObjects.Has(key.IDField())
+	})
+	return nil
+}
+
+// Warm fetches keys in the background, so they are in the cache, when they are
+// requested.
+//
+// Keys that are already in the cache or pending are skipped. Calls to Get for
+// the warmed keys wait for the background fetch. If the context is canceled,
+// the fetch is stopped. The warmed keys are not counted as hits or misses in
+// the stats.
+func (c *Cache) Warm(ctx context.Context, keys ...dskey.Key) {
+	missingKeys := c.data.MarkPendingUncounted(keys...)
+	if len(missingKeys) == 0 {
+		return
+	}
+
+	c.startFetch(ctx, missingKeys, true)
+}
@@ -0,0 +1,233 @@
+package cache_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/cache"
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+func TestCache_InvalidateCollection_refetches_the_collection(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: hugo
+		motion/1/title: title
+		`),
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	userKey := dskey.MustKey("user/1/username")
+	motionKey := dskey.MustKey("motion/1/title")
+	c := cache.New(ds)
+
+	if _, err := c.Get(ctx, userKey, motionKey); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if err := c.InvalidateCollection("motion"); err != nil {
+		t.Fatalf("InvalidateCollection: %v", err)
+	}
+
+	if _, err := c.Get(ctx, userKey, motionKey); err != nil {
+		t.Fatalf("second Get: %v", err)
+	}
+
+	counter := ds.Middlewares()[0].(*dsmock.Counter)
+	if got := counter.Requests(); len(got) != 2 || !reflect.DeepEqual(got[1], []dskey.Key{motionKey}) {
+		t.Errorf("got requests %v, expected the motion key to be fetched again", got)
+	}
+
+	if err := c.InvalidateCollection("unknown"); err == nil {
+		t.Errorf("InvalidateCollection with unknown collection returned no error")
+	}
+}
+
+func TestCache_InvalidateFQID_refetches_the_object(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: hugo
+		user/1/first_name: Hugo
+		user/2/username: max
+		`),
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	keys := []dskey.Key{
+		dskey.MustKey("user/1/username"),
+		dskey.MustKey("user/1/first_name"),
+		dskey.MustKey("user/2/username"),
+	}
+	c := cache.New(ds)
+
+	if _, err := c.Get(ctx, keys...); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if err := c.InvalidateFQID("user/1"); err != nil {
+		t.Fatalf("InvalidateFQID: %v", err)
+	}
+
+	if _, err := c.Get(ctx, keys...); err != nil {
+		t.Fatalf("second Get: %v", err)
+	}
+
+	counter := ds.Middlewares()[0].(*dsmock.Counter)
+	requests := counter.Requests()
+	if len(requests) != 2 || len(requests[1]) != 2 {
+		t.Errorf("got requests %v, expected the two keys of user/1 to be fetched again", requests)
+	}
+
+	if err := c.InvalidateFQID("user"); err == nil {
+		t.Errorf("InvalidateFQID with invalid fqid returned no error")
+	}
+}
+
+func TestCache_InvalidateMeeting_removes_objects_of_the_meeting(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		meeting/1/name: first
+		meeting/2/name: second
+		motion/1/meeting_id: 1
+		motion/1/title: first motion
+		motion/2/meeting_id: 2
+		motion/2/title: second motion
+		topic/1/meeting_id: 1
+		topic/1/title: topic
+		user/1/username: hugo
+		`),
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	c := cache.New(ds)
+
+	// The meeting_id of the topic is not in the cache.
+	keys := []dskey.Key{
+		dskey.MustKey("meeting/1/name"),
+		dskey.MustKey("meeting/2/name"),
+		dskey.MustKey("motion/1/meeting_id"),
+		dskey.MustKey("motion/1/title"),
+		dskey.MustKey("motion/2/meeting_id"),
+		dskey.MustKey("motion/2/title"),
+		dskey.MustKey("topic/1/title"),
+		dskey.MustKey("user/1/username"),
+	}
+	if _, err := c.Get(ctx, keys...); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if err := c.InvalidateMeeting(ctx, 1); err != nil {
+		t.Fatalf("InvalidateMeeting: %v", err)
+	}
+
+	counter := ds.Middlewares()[0].(*dsmock.Counter)
+	counter.Reset()
+
+	if _, err := c.Get(ctx, keys...); err != nil {
+		t.Fatalf("second Get: %v", err)
+	}
+
+	expect := []dskey.Key{
+		dskey.MustKey("meeting/1/name"),
+		dskey.MustKey("motion/1/meeting_id"),
+		dskey.MustKey("motion/1/title"),
+		dskey.MustKey("topic/1/title"),
+	}
+	requests := counter.Requests()
+	if len(requests) != 1 || !sameKeys(requests[0], expect) {
+		t.Errorf("got requests %v, expected %v", requests, expect)
+	}
+}
+
+func TestCache_Warm_fetches_in_the_background(t *testing.T) {
+	ctx := context.Background()
+
+	waiter := make(chan error, 1)
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: hugo
+		`),
+		dsmock.NewWait(waiter),
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	myKey := dskey.MustKey("user/1/username")
+	c := cache.New(ds)
+
+	// Warm does not block, even when the flow blocks.
+	c.Warm(ctx, myKey)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Get(ctx, myKey)
+		done <- err
+	}()
+
+	waiter <- nil
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Get did not return")
+	}
+
+	counter := ds.Middlewares()[1].(*dsmock.Counter)
+	if got := len(counter.Requests()); got != 1 {
+		t.Errorf("got %d requests, expected 1", got)
+	}
+}
+
+func TestCache_Warm_is_not_counted_in_the_stats(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(dsmock.YAMLData(`---
+	user/1/username: hugo
+	user/2/username: gustav
+	`))
+	c := cache.New(ds)
+
+	c.Warm(ctx, dskey.MustKey("user/1/username"), dskey.MustKey("user/2/username"))
+
+	// The first Get can wait for the warm up. The second Get finds the key in
+	// the cache.
+	for range 2 {
+		if _, err := c.Get(ctx, dskey.MustKey("user/1/username")); err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+	}
+
+	// The second warm finds the keys in the cache.
+	c.Warm(ctx, dskey.MustKey("user/1/username"), dskey.MustKey("user/2/username"))
+
+	stats := c.Stats()
+	if stats.Hits == 0 || stats.Misses != 0 {
+		t.Errorf("got %d hits and %d misses, expected only hits", stats.Hits, stats.Misses)
+	}
+}
+
+func sameKeys(got, expect []dskey.Key) bool {
+	if len(got) != len(expect) {
+		return false
+	}
+
+	seen := make(map[dskey.Key]bool, len(got))
+	for _, key := range got {
+		seen[key] = true
+	}
+
+	for _, key := range expect {
+		if !seen[key] {
+			return false
+		}
+	}
+	return true
+}
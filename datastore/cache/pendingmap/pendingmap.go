@@ -3,7 +3,10 @@ package pendingmap
 import (
 	"context"
 	"errors"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/OpenSlides/openslides-go/datastore/dskey"
 )
@@ -21,7 +24,8 @@ var ErrNotExist = errors.New("key does not exist")
 // Each key has one of three states: Not exists, pending, exists.
 //
 // A key that exists can be updated but not deleted. So if a key exists once, it
-// will be in the existing state forever.
+// will be in the existing state forever. The only exceptions are Reset() and
+// the eviction of a bounded PendingMap.
 //
 // A key that not exists can be set to pending or to existing.
 //
@@ -38,17 +42,61 @@ var ErrNotExist = errors.New("key does not exist")
 // To set a value, there are different methods. SetIfExist() sets values if they
 // are pending or already stored. SetIfPending() sets a value only if it is
 // pending. SetEmptyIfPending() sets a value to its zero value if it is pending.
+//
+// A PendingMap created with NewBounded evicts existing keys with the CLOCK
+// algorithm, when its memory usage is bigger then the budget. An evicted key
+// goes back to the not exist state. Pending keys are never evicted.
 type PendingMap struct {
 	mu      sync.RWMutex
-	data    map[dskey.Key][]byte
+	data    map[dskey.Key]*entry
 	pending map[dskey.Key]chan struct{}
+
+	// size is the size of all values in bytes.
+	size int
+
+	// maxSize is the memory budget. 0 means unlimited.
+	maxSize int
+
+	// clock contains all existing keys in the order of the CLOCK algorithm.
+	clock []dskey.Key
+	hand  int
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+// entryOverhead is the estimated memory usage of one key without the value.
+// It is used to compare the memory usage with the budget.
+const entryOverhead = 64
+
+type entry struct {
+	value      []byte
+	slot       int
+	referenced atomic.Bool
+
+	// stored is the time, when the value was set the last time.
+	stored time.Time
+
+	// refreshing is true, while the value is fetched again in the
+	// background.
+	refreshing bool
 }
 
 // New initializes a pendingDict.
 func New() *PendingMap {
+	return NewBounded(0)
+}
+
+// NewBounded initializes a pendingDict with a memory budget in bytes.
+//
+// The memory usage is calculated as the size of the values plus an estimated
+// overhead for each key. 0 means, that there is no budget.
+func NewBounded(maxSize int) *PendingMap {
 	return &PendingMap{
-		data:    make(map[dskey.Key][]byte),
+		data:    make(map[dskey.Key]*entry),
 		pending: make(map[dskey.Key]chan struct{}),
+		maxSize: maxSize,
 	}
 }
 
@@ -75,11 +123,12 @@ func (pm *PendingMap) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key
 	out := make(map[dskey.Key][]byte, len(keys))
 	err := pm.reading(func() error {
 		for _, k := range keys {
-			v, ok := pm.data[k]
+			e, ok := pm.data[k]
 			if !ok {
 				return ErrNotExist
 			}
-			out[k] = v
+			e.referenced.Store(true)
+			out[k] = e.value
 		}
 		return nil
 	})
@@ -136,11 +185,29 @@ func (pm *PendingMap) waitForPending(ctx context.Context, keys []dskey.Key) erro
 // Skips keys that are already pending or are already in the map.
 //
 // Returns all keys that where marked as pending (did not exist).
+//
+// Keys that exist are counted as hits, keys that are marked as misses.
 func (pm *PendingMap) MarkPending(keys ...dskey.Key) []dskey.Key {
+	return pm.markPending(keys, true)
+}
+
+// MarkPendingUncounted is like MarkPending, but does not count hits or misses.
+//
+// It can be used for keys, that are not requested, for example to warm the
+// cache.
+func (pm *PendingMap) MarkPendingUncounted(keys ...dskey.Key) []dskey.Key {
+	return pm.markPending(keys, false)
+}
+
+func (pm *PendingMap) markPending(keys []dskey.Key, count bool) []dskey.Key {
 	var needMark []dskey.Key
 	pm.reading(func() error {
 		for _, key := range keys {
-			if _, inStore := pm.data[key]; inStore {
+			if e, inStore := pm.data[key]; inStore {
+				if count {
+					e.referenced.Store(true)
+					pm.hits.Add(1)
+				}
 				continue
 			}
 			if _, isPending := pm.pending[key]; isPending {
@@ -174,6 +241,9 @@ func (pm *PendingMap) MarkPending(keys ...dskey.Key) []dskey.Key {
 		pm.pending[key] = make(chan struct{})
 		marked = append(marked, key)
 	}
+	if count {
+		pm.misses.Add(uint64(len(marked)))
+	}
 	return marked
 }
 
@@ -214,38 +284,329 @@ func (pm *PendingMap) SetIfPendingOrExists(data map[dskey.Key][]byte) {
 			continue
 		}
 
-		pm.data[key] = value
+		pm.store(key, value)
 
 		if pending != nil {
 			close(pending)
 			delete(pm.pending, key)
 		}
 	}
+	pm.evict()
 }
 
 // SetIfPending updates values but only if the key is pending.
 //
 // Informs all listeners.
-func (pm *PendingMap) SetIfPending(data map[dskey.Key][]byte) {
+//
+// Returns the values, that were set. A bounded PendingMap can evict them
+// again, before a listener reads them, if they do not fit into the budget.
+func (pm *PendingMap) SetIfPending(data map[dskey.Key][]byte) map[dskey.Key][]byte {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
+	set := make(map[dskey.Key][]byte, len(data))
 	for key, value := range data {
 		if pending, isPending := pm.pending[key]; isPending {
-			pm.data[key] = value
+			pm.store(key, value)
+			close(pending)
+			delete(pm.pending, key)
+			set[key] = value
+		}
+	}
+	pm.evict()
+	return set
+}
+
+// store sets the value of a key. Has to be called with the write lock.
+//
+// New keys start with the referenced bit, so they are not evicted, before the
+// waiting callers can read them.
+func (pm *PendingMap) store(key dskey.Key, value []byte) {
+	if e, ok := pm.data[key]; ok {
+		pm.size += len(value) - len(e.value)
+		e.value = value
+		e.stored = time.Now()
+		e.refreshing = false
+		return
+	}
+
+	e := &entry{value: value, slot: len(pm.clock), stored: time.Now()}
+	e.referenced.Store(true)
+	pm.data[key] = e
+	pm.clock = append(pm.clock, key)
+	pm.size += len(value)
+}
+
+// remove deletes an existing key. Has to be called with the write lock.
+func (pm *PendingMap) remove(key dskey.Key) {
+	e := pm.data[key]
+	last := len(pm.clock) - 1
+
+	moved := pm.clock[last]
+	pm.clock[e.slot] = moved
+	pm.data[moved].slot = e.slot
+	pm.clock = pm.clock[:last]
+
+	delete(pm.data, key)
+	pm.size -= len(e.value)
+}
+
+// evict removes keys until the memory usage is inside the budget. Has to be
+// called with the write lock.
+//
+// Uses the CLOCK algorithm. A key that was read since the hand passed it the
+// last time gets a second chance.
+func (pm *PendingMap) evict() {
+	if pm.maxSize <= 0 {
+		return
+	}
+
+	for len(pm.clock) > 0 && pm.size+len(pm.data)*entryOverhead > pm.maxSize {
+		if pm.hand >= len(pm.clock) {
+			pm.hand = 0
+		}
+
+		key := pm.clock[pm.hand]
+		if pm.data[key].referenced.Swap(false) {
+			pm.hand++
+			continue
+		}
+
+		// remove moves the last key into the slot of the hand, so the hand
+		// does not have to move.
+		pm.remove(key)
+		pm.evictions.Add(1)
+	}
+}
+
+// Expire removes the given keys, that exist and for which expired returns true.
+// The function gets the value and the time since the value was set.
+//
+// An expired key goes back to the not exist state, so it can be marked as
+// pending again.
+func (pm *PendingMap) Expire(expired func(key dskey.Key, value []byte, age time.Duration) bool, keys ...dskey.Key) {
+	var toRemove []dskey.Key
+	pm.reading(func() error {
+		now := time.Now()
+		for _, key := range keys {
+			if e, ok := pm.data[key]; ok && expired(key, e.value, now.Sub(e.stored)) {
+				toRemove = append(toRemove, key)
+			}
+		}
+		return nil
+	})
+
+	if len(toRemove) == 0 {
+		return
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	now := time.Now()
+	for _, key := range toRemove {
+		// The key could have been updated or removed in the meantime.
+		if e, ok := pm.data[key]; ok && expired(key, e.value, now.Sub(e.stored)) {
+			pm.remove(key)
+		}
+	}
+}
+
+// MarkRefreshing marks existing keys, for which stale returns true, as
+// refreshing. The function gets the value and the time since the value was
+// set.
+//
+// In contrast to pending keys, a refreshing key can still be read. Use
+// SetIfRefreshing to set the new values.
+//
+// Skips keys that are already refreshing. Returns all keys that were marked.
+func (pm *PendingMap) MarkRefreshing(stale func(key dskey.Key, value []byte, age time.Duration) bool, keys ...dskey.Key) []dskey.Key {
+	var needMark []dskey.Key
+	pm.reading(func() error {
+		now := time.Now()
+		for _, key := range keys {
+			if e, ok := pm.data[key]; ok && !e.refreshing && stale(key, e.value, now.Sub(e.stored)) {
+				needMark = append(needMark, key)
+			}
+		}
+		return nil
+	})
+
+	if len(needMark) == 0 {
+		return nil
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	marked := make([]dskey.Key, 0, len(needMark))
+	for _, key := range needMark {
+		e, ok := pm.data[key]
+		if !ok || e.refreshing {
+			// Another caller was faster.
+			continue
+		}
+
+		e.refreshing = true
+		marked = append(marked, key)
+	}
+	return marked
+}
+
+// UnMarkRefreshing removes the refreshing mark from keys.
+func (pm *PendingMap) UnMarkRefreshing(keys ...dskey.Key) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, key := range keys {
+		if e, ok := pm.data[key]; ok {
+			e.refreshing = false
+		}
+	}
+}
+
+// SetIfRefreshing updates values but only if the key is still refreshing.
+//
+// A key stops refreshing, when it gets a new value from another call, for
+// example from SetIfPendingOrExists. In this case, the value from the refresh
+// could be outdated and is ignored.
+func (pm *PendingMap) SetIfRefreshing(data map[dskey.Key][]byte) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for key, value := range data {
+		if e, ok := pm.data[key]; ok && e.refreshing {
+			pm.store(key, value)
+		}
+	}
+}
+
+// Remove removes all existing and pending keys, for which match returns true.
+//
+// Pending keys are unmarked. Callers waiting for them get ErrNotExist.
+//
+// Returns the amount of removed keys.
+func (pm *PendingMap) Remove(match func(dskey.Key) bool) int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var removed int
+	for key, pending := range pm.pending {
+		if match(key) {
 			close(pending)
 			delete(pm.pending, key)
+			removed++
 		}
 	}
+
+	// remove() changes the order of pm.clock, so the keys are collected first.
+	var toRemove []dskey.Key
+	for _, key := range pm.clock {
+		if match(key) {
+			toRemove = append(toRemove, key)
+		}
+	}
+
+	for _, key := range toRemove {
+		pm.remove(key)
+	}
+
+	return removed + len(toRemove)
+}
+
+// Entries returns a copy of all existing keys and values.
+func (pm *PendingMap) Entries() map[dskey.Key][]byte {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	out := make(map[dskey.Key][]byte, len(pm.data))
+	for key, e := range pm.data {
+		out[key] = e.value
+	}
+	return out
+}
+
+// SetIfMissing sets values for keys, that are not existing and not pending.
+func (pm *PendingMap) SetIfMissing(data map[dskey.Key][]byte) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for key, value := range data {
+		if _, exists := pm.data[key]; exists {
+			continue
+		}
+
+		if _, pending := pm.pending[key]; pending {
+			continue
+		}
+
+		pm.store(key, value)
+	}
+	pm.evict()
+}
+
+// Range calls fn for all existing keys and values.
+//
+// The map is locked for reading while Range runs. So fn has to be fast and
+// must not call other methods of the PendingMap.
+func (pm *PendingMap) Range(fn func(key dskey.Key, value []byte)) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	for key, e := range pm.data {
+		fn(key, e.value)
+	}
+}
+
+// PendingLen returns the amount of pending keys.
+func (pm *PendingMap) PendingLen() int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return len(pm.pending)
+}
+
+// Keys returns all existing keys.
+func (pm *PendingMap) Keys() []dskey.Key {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return slices.Clone(pm.clock)
+}
+
+// Peek returns the values of the given keys, that exist.
+//
+// In contrast to Get, it does not wait for pending keys and does not mark the
+// keys as used.
+func (pm *PendingMap) Peek(keys ...dskey.Key) map[dskey.Key][]byte {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	out := make(map[dskey.Key][]byte)
+	for _, key := range keys {
+		if e, ok := pm.data[key]; ok {
+			out[key] = e.value
+		}
+	}
+	return out
 }
 
 // Reset removes all data from PendingMap
+//
+// Pending keys are unmarked. Callers waiting for them get ErrNotExist.
 func (pm *PendingMap) Reset() {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	pm.data = make(map[dskey.Key][]byte)
+	for _, pending := range pm.pending {
+		close(pending)
+	}
+
+	pm.data = make(map[dskey.Key]*entry)
 	pm.pending = make(map[dskey.Key]chan struct{})
+	pm.clock = nil
+	pm.hand = 0
+	pm.size = 0
 }
 
 // Len returns the amout of keys in the pending map.
@@ -268,9 +629,28 @@ func (pm *PendingMap) Size() int {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
-	var size int
-	for _, v := range pm.data {
-		size += len(v)
+	return pm.size
+}
+
+// Stats contains counters of a PendingMap.
+type Stats struct {
+	// Hits is the amount of requested keys, that already existed.
+	Hits uint64
+
+	// Misses is the amount of requested keys, that had to be marked as
+	// pending.
+	Misses uint64
+
+	// Evictions is the amount of keys, that were removed to stay inside the
+	// memory budget.
+	Evictions uint64
+}
+
+// Stats returns the counters of the PendingMap.
+func (pm *PendingMap) Stats() Stats {
+	return Stats{
+		Hits:      pm.hits.Load(),
+		Misses:    pm.misses.Load(),
+		Evictions: pm.evictions.Load(),
 	}
-	return size
 }
@@ -47,3 +47,187 @@ func TestGet_When_a_key_gets_unmarked_while_waiting_an_error_is_returned(t *test
 		t.Errorf("got %v, expected nil", result.data)
 	}
 }
+
+func TestReset_unblocks_waiting_readers(t *testing.T) {
+	ctx := context.Background()
+	pm := pendingmap.New()
+
+	k1 := dskey.MustKey("user/1/username")
+	pm.MarkPending(k1)
+
+	done := make(chan error)
+	go func() {
+		_, err := pm.Get(ctx, k1)
+		done <- err
+	}()
+
+	time.Sleep(time.Millisecond)
+	pm.Reset()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, pendingmap.ErrNotExist) {
+			t.Errorf("got error: %v, expected %v", err, pendingmap.ErrNotExist)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Get is still blocking after Reset")
+	}
+}
+
+// entrySize is the memory usage of one key with a value of 10 bytes.
+const entrySize = 64 + 10
+
+func set(pm *pendingmap.PendingMap, key dskey.Key) {
+	pm.MarkPending(key)
+	pm.SetIfPending(map[dskey.Key][]byte{key: []byte("0123456789")})
+}
+
+func TestBounded_keeps_keys_that_where_read(t *testing.T) {
+	ctx := context.Background()
+	pm := pendingmap.NewBounded(2 * entrySize)
+
+	k1 := dskey.MustKey("user/1/username")
+	k2 := dskey.MustKey("user/2/username")
+	k3 := dskey.MustKey("user/3/username")
+	k4 := dskey.MustKey("user/4/username")
+
+	set(pm, k1)
+	set(pm, k2)
+	set(pm, k3)
+
+	if _, err := pm.Get(ctx, k2); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	set(pm, k4)
+
+	if got := pm.Len(); got != 2 {
+		t.Errorf("Len() == %d, expected 2", got)
+	}
+
+	if marked := pm.MarkPending(k2, k4); len(marked) != 0 {
+		t.Errorf("keys %v where evicted, expected k2 and k4 to exist", marked)
+	}
+
+	if got := pm.Stats().Evictions; got != 2 {
+		t.Errorf("got %d evictions, expected 2", got)
+	}
+}
+
+func TestBounded_does_not_evict_pending_keys(t *testing.T) {
+	ctx := context.Background()
+	pm := pendingmap.NewBounded(entrySize)
+
+	pendingKey := dskey.MustKey("user/1/username")
+	pm.MarkPending(pendingKey)
+
+	done := make(chan error)
+	go func() {
+		_, err := pm.Get(ctx, pendingKey)
+		done <- err
+	}()
+
+	for id := 2; id < 10; id++ {
+		set(pm, dskey.MustKeyf("user/%d/username", id))
+	}
+
+	pm.SetIfPending(map[dskey.Key][]byte{pendingKey: []byte("value")})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Get: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Get is still blocking")
+	}
+}
+
+func TestStats_counts_hits_and_misses(t *testing.T) {
+	pm := pendingmap.New()
+
+	k1 := dskey.MustKey("user/1/username")
+	k2 := dskey.MustKey("user/2/username")
+
+	set(pm, k1)
+	pm.MarkPending(k1, k2)
+
+	expect := pendingmap.Stats{Hits: 1, Misses: 2}
+	if got := pm.Stats(); got != expect {
+		t.Errorf("Stats() == %v, expected %v", got, expect)
+	}
+}
+
+func TestSetIfRefreshing_ignores_values_that_where_updated(t *testing.T) {
+	ctx := context.Background()
+	pm := pendingmap.New()
+
+	k1 := dskey.MustKey("user/1/username")
+	k2 := dskey.MustKey("user/2/username")
+	set(pm, k1)
+	set(pm, k2)
+
+	always := func(dskey.Key, []byte, time.Duration) bool { return true }
+	if marked := pm.MarkRefreshing(always, k1, k2); len(marked) != 2 {
+		t.Fatalf("marked %v, expected both keys", marked)
+	}
+
+	if marked := pm.MarkRefreshing(always, k1, k2); len(marked) != 0 {
+		t.Errorf("marked %v a second time", marked)
+	}
+
+	pm.SetIfPendingOrExists(map[dskey.Key][]byte{k1: []byte("from update")})
+	pm.SetIfRefreshing(map[dskey.Key][]byte{
+		k1: []byte("from refresh"),
+		k2: []byte("from refresh"),
+	})
+
+	got, err := pm.Get(ctx, k1, k2)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if string(got[k1]) != "from update" || string(got[k2]) != "from refresh" {
+		t.Errorf("got %s and %s, expected `from update` and `from refresh`", got[k1], got[k2])
+	}
+}
+
+func TestExpire_removes_expired_keys(t *testing.T) {
+	pm := pendingmap.New()
+
+	k1 := dskey.MustKey("user/1/username")
+	k2 := dskey.MustKey("user/2/username")
+	set(pm, k1)
+	pm.MarkPending(k2)
+	pm.SetIfPending(map[dskey.Key][]byte{k2: nil})
+
+	pm.Expire(func(_ dskey.Key, value []byte, _ time.Duration) bool {
+		return value == nil
+	}, k1, k2)
+
+	if marked := pm.MarkPending(k1, k2); len(marked) != 1 || marked[0] != k2 {
+		t.Errorf("marked %v, expected only the expired key", marked)
+	}
+}
+
+func TestRange_and_PendingLen(t *testing.T) {
+	pm := pendingmap.New()
+
+	k1 := dskey.MustKey("user/1/username")
+	k2 := dskey.MustKey("user/2/username")
+	set(pm, k1)
+	pm.MarkPending(k2)
+
+	var keys []dskey.Key
+	pm.Range(func(key dskey.Key, _ []byte) {
+		keys = append(keys, key)
+	})
+
+	if len(keys) != 1 || keys[0] != k1 {
+		t.Errorf("Range called with %v, expected only the existing key", keys)
+	}
+
+	if got := pm.PendingLen(); got != 1 {
+		t.Errorf("PendingLen() = %d, expected 1", got)
+	}
+}
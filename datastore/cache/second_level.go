@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+	"github.com/OpenSlides/openslides-go/oslog"
+)
+
+// SecondLevel is a cache, that can be shared between many instances of a
+// service. For example redis.SharedCache.
+type SecondLevel interface {
+	// Get returns the values of the keys, that are in the second level cache.
+	// Keys, that are not in the cache, are not in the returned map. A key
+	// with the value nil is known to not exist.
+	Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error)
+
+	// SetIfExists writes only the values of keys, that are in the cache.
+	SetIfExists(ctx context.Context, data map[dskey.Key][]byte) error
+
+	// SetIfMissing writes only the values of keys, that are not in the cache.
+	SetIfMissing(ctx context.Context, data map[dskey.Key][]byte) error
+
+	// Reset removes all values from the cache.
+	Reset(ctx context.Context) error
+}
+
+// secondLevelFlow asks a second level cache before the flow.
+type secondLevelFlow struct {
+	secondLevel SecondLevel
+	flow        flow.Flow
+}
+
+// WithSecondLevel returns a flow, that reads values from the second level
+// cache before it asks the given flow. Values from the flow are written to the
+// second level cache. Updates of keys, that are in the second level cache, are
+// written through, so all instances, that share the second level cache, get
+// the new values. Other keys are not written, because no instance has fetched
+// them.
+//
+// Values fetched from the flow do not overwrite values in the second level
+// cache. So a slow fetch can not overwrite a newer value from an update.
+//
+// Errors from the second level cache are logged. In this case, the values are
+// read from the flow.
+//
+// Use it as flow for the cache:
+//
+//	c := cache.New(cache.WithSecondLevel(sharedCache, flow))
+func WithSecondLevel(secondLevel SecondLevel, flow flow.Flow) flow.Flow {
+	return &secondLevelFlow{
+		secondLevel: secondLevel,
+		flow:        flow,
+	}
+}
+
+// Get reads the keys from the second level cache. Missing keys are fetched
+// from the flow.
+func (s *secondLevelFlow) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	values, err := s.secondLevel.Get(ctx, keys...)
+	if err != nil {
+		oslog.Warn("Reading from second level cache: %v", err)
+		values = nil
+	}
+
+	if values == nil {
+		values = make(map[dskey.Key][]byte, len(keys))
+	}
+
+	var missing []dskey.Key
+	for _, key := range keys {
+		if _, ok := values[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) == 0 {
+		return values, nil
+	}
+
+	fetched, err := s.flow.Get(ctx, missing...)
+	var degraded *flow.DegradedError
+	if err != nil && !errors.As(err, &degraded) {
+		return nil, err
+	}
+
+	toStore := fetched
+	if degraded != nil {
+		// Replaced values are returned with the error, but not cached.
+		toStore = maps.Clone(fetched)
+		for _, key := range degraded.Keys {
+			delete(toStore, key)
+		}
+	}
+
+	if err := s.secondLevel.SetIfMissing(ctx, toStore); err != nil {
+		oslog.Warn("Writing to second level cache: %v", err)
+	}
+
+	for key, value := range fetched {
+		values[key] = value
+	}
+
+	return values, err
+}
+
+// Update writes the updates to the second level cache.
+func (s *secondLevelFlow) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
+	s.UpdateWithPosition(ctx, func(_ uint64, data map[dskey.Key][]byte, err error) {
+		updateFn(data, err)
+	})
+}
+
+// handleUpdate returns an update function, that writes the updates to the
+// second level cache and calls updateFn.
+func (s *secondLevelFlow) handleUpdate(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) func(uint64, map[dskey.Key][]byte, error) {
+	return func(position uint64, data map[dskey.Key][]byte, err error) {
+		if err != nil {
+			if errors.Is(err, flow.ErrMissedUpdates) {
+				if err := s.secondLevel.Reset(ctx); err != nil {
+					oslog.Warn("Resetting second level cache: %v", err)
+				}
+			}
+			updateFn(0, nil, err)
+			return
+		}
+
+		if err := s.secondLevel.SetIfExists(ctx, data); err != nil {
+			oslog.Warn("Writing update to second level cache: %v", err)
+		}
+		updateFn(position, data, nil)
+	}
+}
+
+// UpdateWithPosition is like Update, but also returns the position of the
+// update.
+//
+// If the flow reports flow.ErrMissedUpdates, the second level cache is reset.
+func (s *secondLevelFlow) UpdateWithPosition(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	if positionFlow, ok := s.flow.(flow.UpdaterWithPosition); ok {
+		positionFlow.UpdateWithPosition(ctx, s.handleUpdate(ctx, updateFn))
+		return
+	}
+
+	handleUpdate := s.handleUpdate(ctx, updateFn)
+	s.flow.Update(ctx, func(data map[dskey.Key][]byte, err error) {
+		handleUpdate(0, data, err)
+	})
+}
+
+// UpdateFromPosition calls UpdateFromPosition of the flow and writes the
+// updates to the second level cache like UpdateWithPosition. If the flow is
+// not a flow.Resumer, flow.ErrMissedUpdates is reported and only new updates
+// are sent.
+func (s *secondLevelFlow) UpdateFromPosition(ctx context.Context, position uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	resumer, ok := s.flow.(flow.Resumer)
+	if !ok {
+		if position != 0 {
+			s.handleUpdate(ctx, updateFn)(0, nil, flow.ErrMissedUpdates)
+		}
+		s.UpdateWithPosition(ctx, updateFn)
+		return
+	}
+
+	resumer.UpdateFromPosition(ctx, position, s.handleUpdate(ctx, updateFn))
+}
+
+// ResumePosition returns the resume position of the flow or 0, if it does not
+// implement flow.Resumer.
+func (s *secondLevelFlow) ResumePosition() uint64 {
+	resumer, ok := s.flow.(flow.Resumer)
+	if !ok {
+		return 0
+	}
+	return resumer.ResumePosition()
+}
+
+// CoversPosition calls CoversPosition of the flow.
+func (s *secondLevelFlow) CoversPosition(ctx context.Context, position uint64) (bool, error) {
+	resumer, ok := s.flow.(flow.Resumer)
+	if !ok {
+		return false, fmt.Errorf("flow does not support resuming")
+	}
+	return resumer.CoversPosition(ctx, position)
+}
@@ -0,0 +1,205 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/OpenSlides/openslides-go/datastore/cache"
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+// memorySecondLevel is a SecondLevel in memory.
+type memorySecondLevel struct {
+	mu   sync.Mutex
+	data map[dskey.Key][]byte
+}
+
+func newMemorySecondLevel(data map[dskey.Key][]byte) *memorySecondLevel {
+	if data == nil {
+		data = make(map[dskey.Key][]byte)
+	}
+	return &memorySecondLevel{data: data}
+}
+
+func (m *memorySecondLevel) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[dskey.Key][]byte)
+	for _, key := range keys {
+		if value, ok := m.data[key]; ok {
+			out[key] = value
+		}
+	}
+	return out, nil
+}
+
+func (m *memorySecondLevel) SetIfExists(ctx context.Context, data map[dskey.Key][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, value := range data {
+		if _, ok := m.data[key]; ok {
+			m.data[key] = value
+		}
+	}
+	return nil
+}
+
+func (m *memorySecondLevel) SetIfMissing(ctx context.Context, data map[dskey.Key][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, value := range data {
+		if _, ok := m.data[key]; !ok {
+			m.data[key] = value
+		}
+	}
+	return nil
+}
+
+func (m *memorySecondLevel) Reset(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.data = make(map[dskey.Key][]byte)
+	return nil
+}
+
+func TestWithSecondLevel_reads_from_the_second_level_first(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: from flow
+		user/2/username: from flow
+		`),
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	k1 := dskey.MustKey("user/1/username")
+	k2 := dskey.MustKey("user/2/username")
+
+	secondLevel := newMemorySecondLevel(map[dskey.Key][]byte{k1: []byte(`"from second level"`)})
+	c := cache.New(cache.WithSecondLevel(secondLevel, ds))
+
+	got, err := c.Get(ctx, k1, k2)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	expect := map[dskey.Key][]byte{
+		k1: []byte(`"from second level"`),
+		k2: []byte(`"from flow"`),
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Get() == %v, expected %v", got, expect)
+	}
+
+	counter := ds.Middlewares()[0].(*dsmock.Counter)
+	if got := counter.Requests(); !reflect.DeepEqual(got, [][]dskey.Key{{k2}}) {
+		t.Errorf("got requests %v, expected only k2", got)
+	}
+
+	stored, _ := secondLevel.Get(ctx, k2)
+	if string(stored[k2]) != `"from flow"` {
+		t.Errorf("value from the flow was not written to the second level cache")
+	}
+}
+
+func TestWithSecondLevel_writes_updates_through(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.NewFlow(dsmock.YAMLData(`---
+	user/1/username: old
+	`))
+	myKey := dskey.MustKey("user/1/username")
+
+	secondLevel := newMemorySecondLevel(map[dskey.Key][]byte{myKey: []byte(`"old"`)})
+	c := cache.New(cache.WithSecondLevel(secondLevel, ds))
+
+	received := make(chan error, 1)
+	go c.Update(ctx, func(_ map[dskey.Key][]byte, err error) {
+		received <- err
+	})
+
+	otherKey := dskey.MustKey("user/2/username")
+	ds.Send(map[dskey.Key][]byte{myKey: []byte(`"new"`), otherKey: []byte(`"other"`)})
+	if err := <-received; err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	stored, _ := secondLevel.Get(ctx, myKey, otherKey)
+	if string(stored[myKey]) != `"new"` {
+		t.Errorf("second level cache contains %s, expected the updated value", stored[myKey])
+	}
+
+	if _, ok := stored[otherKey]; ok {
+		t.Errorf("second level cache contains a key, that was not in it before the update")
+	}
+}
+
+func TestWithSecondLevel_snapshot_resumes_the_flow(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	source := &resumerFlow{
+		Flow:     dsmock.NewFlow(dsmock.YAMLData(`user/1/username: hugo`)),
+		position: 42,
+	}
+	c := cache.New(cache.WithSecondLevel(newMemorySecondLevel(nil), source))
+
+	if _, err := c.Get(ctx, dskey.MustKey("user/1/username")); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if err := c.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	target := &resumerFlow{Flow: dsmock.NewFlow(nil), covered: true}
+	restored := cache.New(cache.WithSecondLevel(newMemorySecondLevel(nil), target))
+
+	if err := restored.LoadSnapshot(ctx, path); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+
+	restored.Update(ctx, nil)
+	if target.resumedFrom != 42 {
+		t.Errorf("updates resumed from %d, expected 42", target.resumedFrom)
+	}
+}
+
+func TestWithSecondLevel_resets_on_missed_updates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	myKey := dskey.MustKey("user/1/username")
+	secondLevel := newMemorySecondLevel(map[dskey.Key][]byte{myKey: []byte(`"old"`)})
+	ds := positionFlow{
+		Flow: dsmock.NewFlow(dsmock.YAMLData(``)),
+		ch:   make(chan positionUpdate),
+	}
+	c := cache.New(cache.WithSecondLevel(secondLevel, ds))
+
+	received := make(chan error, 1)
+	go c.Update(ctx, func(_ map[dskey.Key][]byte, err error) {
+		received <- err
+	})
+
+	ds.ch <- positionUpdate{err: flow.ErrMissedUpdates}
+
+	if err := <-received; !errors.Is(err, flow.ErrMissedUpdates) {
+		t.Errorf("Update called with error %v, expected %v", err, flow.ErrMissedUpdates)
+	}
+
+	if stored, _ := secondLevel.Get(ctx, myKey); len(stored) != 0 {
+		t.Errorf("second level cache was not reset")
+	}
+}
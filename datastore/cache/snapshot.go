@@ -0,0 +1,227 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+// snapshotMagic is the start of a snapshot file. The last byte is the version
+// of the format.
+var snapshotMagic = []byte("OSCACHE\x01")
+
+// ErrSnapshotOutdated is returned by LoadSnapshot, when the changes since the
+// snapshot can not be received anymore.
+var ErrSnapshotOutdated = errors.New("snapshot is outdated")
+
+// SaveSnapshot writes all values of the cache and the position of the last
+// update to a file.
+//
+// The flow has to implement flow.Resumer. It has to be called after the
+// first update, so the position is known.
+//
+// The file is replaced atomically.
+func (c *Cache) SaveSnapshot(path string) error {
+	resumer, ok := c.flow.(flow.Resumer)
+	if !ok {
+		return fmt.Errorf("flow does not support resuming updates")
+	}
+
+	// The position has to be read before the data. If an update happens in
+	// between, it is in the data and is received again after loading.
+	position := resumer.ResumePosition()
+	if position == 0 {
+		return fmt.Errorf("no position known, update was not called")
+	}
+
+	data := c.data.Entries()
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("creating snapshot file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	if err := writeSnapshot(file, position, data); err != nil {
+		file.Close()
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing snapshot file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("replacing snapshot file: %w", err)
+	}
+
+	return nil
+}
+
+// LoadSnapshot reads the values from a file created with SaveSnapshot.
+//
+// If the flow can not send the changes since the snapshot anymore, it returns
+// ErrSnapshotOutdated and the cache stays empty. Otherwise, the next call to
+// Update or UpdateWithPosition sends all changes since the snapshot first.
+//
+// LoadSnapshot has to be called before Update. Keys, that are already in the
+// cache, are not overwritten.
+func (c *Cache) LoadSnapshot(ctx context.Context, path string) error {
+	resumer, ok := c.flow.(flow.Resumer)
+	if !ok {
+		return fmt.Errorf("flow does not support resuming updates")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+
+	position, err := readSnapshotHeader(r)
+	if err != nil {
+		return fmt.Errorf("reading snapshot header: %w", err)
+	}
+
+	covered, err := resumer.CoversPosition(ctx, position)
+	if err != nil {
+		return fmt.Errorf("checking snapshot position: %w", err)
+	}
+
+	if !covered {
+		return fmt.Errorf("position %d: %w", position, ErrSnapshotOutdated)
+	}
+
+	data, err := readSnapshotData(r)
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	c.data.SetIfMissing(data)
+	c.resumeFrom.Store(position)
+	return nil
+}
+
+// writeSnapshot writes the snapshot format.
+//
+// After the magic bytes, the position is written as uvarint. Each entry is
+// the key as string with its length as uvarint and the value with its length
+// as varint. A length of -1 means nil. A key with the length 0 ends the
+// snapshot.
+func writeSnapshot(w io.Writer, position uint64, data map[dskey.Key][]byte) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	if _, err := bw.Write(snapshotMagic); err != nil {
+		return err
+	}
+
+	if _, err := bw.Write(binary.AppendUvarint(buf[:0], position)); err != nil {
+		return err
+	}
+
+	for key, value := range data {
+		keyStr := key.String()
+		if _, err := bw.Write(binary.AppendUvarint(buf[:0], uint64(len(keyStr)))); err != nil {
+			return err
+		}
+
+		if _, err := bw.WriteString(keyStr); err != nil {
+			return err
+		}
+
+		valueLen := int64(len(value))
+		if value == nil {
+			valueLen = -1
+		}
+
+		if _, err := bw.Write(binary.AppendVarint(buf[:0], valueLen)); err != nil {
+			return err
+		}
+
+		if _, err := bw.Write(value); err != nil {
+			return err
+		}
+	}
+
+	if _, err := bw.Write(binary.AppendUvarint(buf[:0], 0)); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func readSnapshotHeader(r *bufio.Reader) (uint64, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return 0, fmt.Errorf("reading magic bytes: %w", err)
+	}
+
+	if string(magic) != string(snapshotMagic) {
+		return 0, fmt.Errorf("invalid file format")
+	}
+
+	position, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("reading position: %w", err)
+	}
+
+	return position, nil
+}
+
+// readSnapshotData reads the entries of a snapshot.
+//
+// Keys, that do not exist anymore, for example after a change of the models,
+// are skipped.
+func readSnapshotData(r *bufio.Reader) (map[dskey.Key][]byte, error) {
+	data := make(map[dskey.Key][]byte)
+	for {
+		keyLen, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading key length: %w", err)
+		}
+
+		if keyLen == 0 {
+			return data, nil
+		}
+
+		keyStr := make([]byte, keyLen)
+		if _, err := io.ReadFull(r, keyStr); err != nil {
+			return nil, fmt.Errorf("reading key: %w", err)
+		}
+
+		valueLen, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading value length of %s: %w", keyStr, err)
+		}
+
+		if valueLen < -1 {
+			return nil, fmt.Errorf("invalid value length %d of %s", valueLen, keyStr)
+		}
+
+		var value []byte
+		if valueLen >= 0 {
+			value = make([]byte, valueLen)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return nil, fmt.Errorf("reading value of %s: %w", keyStr, err)
+			}
+		}
+
+		key, err := dskey.FromString(string(keyStr))
+		if err != nil {
+			continue
+		}
+
+		data[key] = value
+	}
+}
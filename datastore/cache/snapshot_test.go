@@ -0,0 +1,136 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/OpenSlides/openslides-go/datastore/cache"
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+// resumerFlow is a flow that implements flow.Resumer.
+type resumerFlow struct {
+	*dsmock.Flow
+
+	position    uint64
+	covered     bool
+	resumedFrom uint64
+}
+
+func (f *resumerFlow) UpdateWithPosition(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	f.UpdateFromPosition(ctx, 0, updateFn)
+}
+
+func (f *resumerFlow) ResumePosition() uint64 {
+	return f.position
+}
+
+func (f *resumerFlow) CoversPosition(ctx context.Context, position uint64) (bool, error) {
+	return f.covered, nil
+}
+
+func (f *resumerFlow) UpdateFromPosition(ctx context.Context, position uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	f.resumedFrom = position
+}
+
+func TestCache_Snapshot_restores_the_values(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	k1 := dskey.MustKey("user/1/username")
+	k2 := dskey.MustKey("user/2/username")
+
+	source := &resumerFlow{
+		Flow: dsmock.NewFlow(dsmock.YAMLData(`---
+		user/1/username: hugo
+		`)),
+		position: 42,
+	}
+	c := cache.New(source)
+
+	expect, err := c.Get(ctx, k1, k2)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if err := c.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	target := &resumerFlow{
+		Flow: dsmock.NewFlow(
+			nil,
+			func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+		),
+		covered: true,
+	}
+	restored := cache.New(target)
+
+	if err := restored.LoadSnapshot(ctx, path); err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+
+	got, err := restored.Get(ctx, k1, k2)
+	if err != nil {
+		t.Fatalf("Get from restored cache: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Get() == %v, expected %v", got, expect)
+	}
+
+	counter := target.Middlewares()[0].(*dsmock.Counter)
+	if counter.Count() != 0 {
+		t.Errorf("restored cache requested %v from the flow", counter.Requests())
+	}
+
+	restored.Update(ctx, nil)
+	if target.resumedFrom != 42 {
+		t.Errorf("updates resumed from %d, expected 42", target.resumedFrom)
+	}
+}
+
+func TestCache_LoadSnapshot_discards_an_outdated_snapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	source := &resumerFlow{
+		Flow: dsmock.NewFlow(dsmock.YAMLData(`---
+		user/1/username: hugo
+		`)),
+		position: 42,
+	}
+	c := cache.New(source)
+
+	if _, err := c.Get(ctx, dskey.MustKey("user/1/username")); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if err := c.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot: %v", err)
+	}
+
+	target := &resumerFlow{Flow: dsmock.NewFlow(nil), covered: false}
+	restored := cache.New(target)
+
+	if err := restored.LoadSnapshot(ctx, path); !errors.Is(err, cache.ErrSnapshotOutdated) {
+		t.Errorf("LoadSnapshot returned %v, expected %v", err, cache.ErrSnapshotOutdated)
+	}
+
+	if got := restored.Len(); got != 0 {
+		t.Errorf("Len() == %d, expected 0", got)
+	}
+}
+
+func TestCache_SaveSnapshot_needs_a_resumer(t *testing.T) {
+	c := cache.New(dsmock.NewFlow(nil))
+
+	if err := c.SaveSnapshot(filepath.Join(t.TempDir(), "cache.snapshot")); err == nil {
+		t.Errorf("SaveSnapshot returned no error")
+	}
+}
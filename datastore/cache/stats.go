@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/oslog"
+)
+
+// largestKeysCount is the amount of keys returned in Stats.LargestKeys.
+const largestKeysCount = 10
+
+// Stats contains information about the content and the usage of the cache.
+//
+// It can be logged with oslog.Metric. See Stats.JSON.
+type Stats struct {
+	// Keys is the amount of keys in the cache.
+	Keys int `json:"keys"`
+
+	// Size is the size of all values in bytes.
+	Size int `json:"size"`
+
+	// PendingKeys is the amount of keys, that are currently fetched from the
+	// flow.
+	PendingKeys int `json:"pending_keys"`
+
+	// Hits is the amount of requested keys, that already existed.
+	Hits uint64 `json:"hits"`
+
+	// Misses is the amount of requested keys, that had to be fetched.
+	Misses uint64 `json:"misses"`
+
+	// Evictions is the amount of keys, that were removed to stay in the
+	// memory budget.
+	Evictions uint64 `json:"evictions"`
+
+	// HitRatio is Hits divided by all requested keys. It is 0, if no key was
+	// requested.
+	HitRatio float64 `json:"hit_ratio"`
+
+	// FlowCalls is the amount of requests to the flow.
+	FlowCalls uint64 `json:"flow_calls"`
+
+	// AverageFlowLatency is the average duration of a request to the flow.
+	AverageFlowLatency time.Duration `json:"average_flow_latency_ns"`
+
+	// Collections contains the amount and size of the keys per collection.
+	Collections map[string]CollectionStats `json:"collections"`
+
+	// LargestKeys are the keys with the biggest values, sorted by size.
+	LargestKeys []KeyStats `json:"largest_keys"`
+}
+
+// CollectionStats contains the amount and the size of the keys of one
+// collection.
+type CollectionStats struct {
+	Keys int `json:"keys"`
+	Size int `json:"size"`
+}
+
+// KeyStats contains the size of the value of one key.
+type KeyStats struct {
+	Key  dskey.Key `json:"-"`
+	Size int       `json:"size"`
+}
+
+// MarshalJSON encodes the key as string.
+func (k KeyStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Key  string `json:"key"`
+		Size int    `json:"size"`
+	}{k.Key.String(), k.Size})
+}
+
+// JSON returns the stats as json object with the name datastore_cache.
+func (s Stats) JSON() (json.RawMessage, error) {
+	return oslog.MetricJSON("datastore_cache", s)
+}
+
+// Stats returns information about the content and the usage of the cache.
+//
+// It iterates over all keys, so it should not be called too often.
+func (c *Cache) Stats() Stats {
+	collections := make(map[string]CollectionStats)
+	var largest []KeyStats
+	var keys, size int
+
+	c.data.Range(func(key dskey.Key, value []byte) {
+		keys++
+		size += len(value)
+
+		collection := collections[key.Collection()]
+		collection.Keys++
+		collection.Size += len(value)
+		collections[key.Collection()] = collection
+
+		largest = addLargest(largest, KeyStats{Key: key, Size: len(value)})
+	})
+
+	counters := c.data.Stats()
+	stats := Stats{
+		Keys:        keys,
+		Size:        size,
+		PendingKeys: c.data.PendingLen(),
+		Hits:        counters.Hits,
+		Misses:      counters.Misses,
+		Evictions:   counters.Evictions,
+		FlowCalls:   c.flowCalls.Load(),
+		Collections: collections,
+		LargestKeys: largest,
+	}
+
+	if requested := stats.Hits + stats.Misses; requested > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(requested)
+	}
+
+	if stats.FlowCalls > 0 {
+		stats.AverageFlowLatency = time.Duration(c.flowDuration.Load() / int64(stats.FlowCalls))
+	}
+
+	return stats
+}
+
+// addLargest adds a key to the sorted list of the largest keys, if it is big
+// enough.
+func addLargest(largest []KeyStats, key KeyStats) []KeyStats {
+	if len(largest) == largestKeysCount && largest[len(largest)-1].Size >= key.Size {
+		return largest
+	}
+
+	idx := sort.Search(len(largest), func(i int) bool {
+		return largest[i].Size < key.Size
+	})
+
+	if len(largest) < largestKeysCount {
+		largest = append(largest, KeyStats{})
+	}
+	copy(largest[idx+1:], largest[idx:])
+	largest[idx] = key
+	return largest
+}
@@ -0,0 +1,103 @@
+package cache_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/OpenSlides/openslides-go/datastore/cache"
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+)
+
+func TestCacheStats(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(dsmock.YAMLData(`---
+	user/1/username: hugo
+	user/2/username: maximilian
+	motion/1/title: a long motion title
+	`))
+	c := cache.New(ds)
+
+	userKey1 := dskey.MustKey("user/1/username")
+	userKey2 := dskey.MustKey("user/2/username")
+	motionKey := dskey.MustKey("motion/1/title")
+
+	if _, err := c.Get(ctx, userKey1, userKey2, motionKey); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if _, err := c.Get(ctx, userKey1); err != nil {
+		t.Fatalf("second Get: %v", err)
+	}
+
+	stats := c.Stats()
+
+	if stats.Keys != 3 {
+		t.Errorf("Keys = %d, expected 3", stats.Keys)
+	}
+
+	if stats.Size != c.Size() {
+		t.Errorf("Size = %d, expected %d", stats.Size, c.Size())
+	}
+
+	if stats.Hits != 1 || stats.Misses != 3 {
+		t.Errorf("Hits = %d, Misses = %d, expected 1 and 3", stats.Hits, stats.Misses)
+	}
+
+	if stats.HitRatio != 0.25 {
+		t.Errorf("HitRatio = %f, expected 0.25", stats.HitRatio)
+	}
+
+	if stats.FlowCalls != 1 {
+		t.Errorf("FlowCalls = %d, expected 1", stats.FlowCalls)
+	}
+
+	expectUser := cache.CollectionStats{Keys: 2, Size: len(`"hugo"`) + len(`"maximilian"`)}
+	if got := stats.Collections["user"]; got != expectUser {
+		t.Errorf("user collection = %v, expected %v", got, expectUser)
+	}
+
+	if len(stats.LargestKeys) != 3 || stats.LargestKeys[0].Key != motionKey || stats.LargestKeys[2].Key != userKey1 {
+		t.Errorf("LargestKeys = %v, expected motion, user/2, user/1", stats.LargestKeys)
+	}
+
+	encoded, err := stats.JSON()
+	if err != nil {
+		t.Fatalf("JSON: %v", err)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("decoding json: %v", err)
+	}
+
+	if decoded["name"] != "datastore_cache" || decoded["keys"] != float64(3) {
+		t.Errorf("got json %s", encoded)
+	}
+
+	largest := decoded["largest_keys"].([]any)[0].(map[string]any)
+	if largest["key"] != "motion/1/title" {
+		t.Errorf("largest key in json = %v, expected motion/1/title", largest["key"])
+	}
+}
+
+func TestCacheStatsEmpty(t *testing.T) {
+	c := cache.New(dsmock.NewFlow(nil))
+
+	stats := c.Stats()
+	if stats.HitRatio != 0 || stats.AverageFlowLatency != 0 {
+		t.Errorf("got %v, expected zero ratio and latency", stats)
+	}
+
+	encoded, err := stats.JSON()
+	if err != nil {
+		t.Fatalf("JSON: %v", err)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Errorf("decoding json: %v", err)
+	}
+}
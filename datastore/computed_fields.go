@@ -0,0 +1,72 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+// computedFields is a registry of fields, that are not stored in postgres. The
+// value is the flow that calculates the field or nil, if the field is
+// calculated by another service.
+var computedFields = struct {
+	mu     sync.RWMutex
+	fields map[string]flow.Flow
+}{
+	fields: map[string]flow.Flow{
+		"poll/live_votes":    nil,
+		"projection/content": nil,
+	},
+}
+
+// RegisterComputedField declares, that a field is not stored in postgres but
+// calculated by a flow.
+//
+// collectionField has the form collection/field. The flow can be nil, if the
+// field is calculated by another service. FlowPostgres does not query computed
+// fields and returns nil for them.
+func RegisterComputedField(collectionField string, f flow.Flow) error {
+	collection, field, ok := strings.Cut(collectionField, "/")
+	if !ok || !dskey.ValidateCollectionField(collection, field) {
+		return fmt.Errorf("unknown field %s", collectionField)
+	}
+
+	computedFields.mu.Lock()
+	defer computedFields.mu.Unlock()
+
+	computedFields.fields[collectionField] = f
+	return nil
+}
+
+// IsComputedField returns true, if the field collection/field is not stored
+// in postgres.
+func IsComputedField(collectionField string) bool {
+	computedFields.mu.RLock()
+	defer computedFields.mu.RUnlock()
+
+	_, ok := computedFields.fields[collectionField]
+	return ok
+}
+
+// CombineComputedFields creates a flow, that uses the registered flows for the
+// computed fields and the default flow for all other fields.
+func CombineComputedFields(defaultFlow flow.Flow) (flow.Flow, error) {
+	computedFields.mu.RLock()
+	defer computedFields.mu.RUnlock()
+
+	sources := make(map[string]flow.Source, len(computedFields.fields))
+	for collectionField, f := range computedFields.fields {
+		if f != nil {
+			sources[collectionField] = flow.Source{Flow: f}
+		}
+	}
+
+	combined, err := flow.CombineSources(flow.Source{Flow: defaultFlow}, sources)
+	if err != nil {
+		return nil, fmt.Errorf("combining computed fields: %w", err)
+	}
+	return combined, nil
+}
@@ -0,0 +1,88 @@
+package datastore_test
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/OpenSlides/openslides-go/datastore"
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+)
+
+func TestRegisterComputedFieldInvalidField(t *testing.T) {
+	for _, collectionField := range []string{"", "user", "user/not_existing", "not_existing/id"} {
+		if err := datastore.RegisterComputedField(collectionField, nil); err == nil {
+			t.Errorf("RegisterComputedField(%q) returned no error", collectionField)
+		}
+	}
+}
+
+func TestCombineComputedFields(t *testing.T) {
+	ctx := context.Background()
+
+	defaultFlow := dsmock.NewFlow(dsmock.YAMLData(`---
+	poll/1/title: from default
+	`))
+	voteFlow := dsmock.NewFlow(dsmock.YAMLData(`---
+	poll/1/live_votes: {"1": "Y"}
+	`))
+
+	if err := datastore.RegisterComputedField("poll/live_votes", voteFlow); err != nil {
+		t.Fatalf("RegisterComputedField: %v", err)
+	}
+	defer datastore.RegisterComputedField("poll/live_votes", nil)
+
+	if !datastore.IsComputedField("poll/live_votes") {
+		t.Errorf("poll/live_votes is not a computed field")
+	}
+
+	if datastore.IsComputedField("poll/title") {
+		t.Errorf("poll/title is a computed field")
+	}
+
+	combined, err := datastore.CombineComputedFields(defaultFlow)
+	if err != nil {
+		t.Fatalf("CombineComputedFields: %v", err)
+	}
+
+	keyTitle := dskey.MustKey("poll/1/title")
+	keyLiveVotes := dskey.MustKey("poll/1/live_votes")
+	got, err := combined.Get(ctx, keyTitle, keyLiveVotes)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	expect := map[dskey.Key][]byte{
+		keyTitle:     []byte(`"from default"`),
+		keyLiveVotes: []byte(`{"1":"Y"}`),
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got %v, expected %v", got, expect)
+	}
+}
+
+func TestCreateKeyListComputedFields(t *testing.T) {
+	liveVotes := dskey.MustKey("poll/1/live_votes")
+
+	for _, operation := range []string{"insert", "update"} {
+		keys, err := datastore.CreateKeyList("poll", 1, operation, nil)
+		if err != nil {
+			t.Fatalf("CreateKeyList(%s): %v", operation, err)
+		}
+
+		if slices.Contains(keys, liveVotes) {
+			t.Errorf("CreateKeyList(%s) returned the computed field", operation)
+		}
+	}
+
+	keys, err := datastore.CreateKeyList("poll", 1, "delete", nil)
+	if err != nil {
+		t.Fatalf("CreateKeyList(delete): %v", err)
+	}
+
+	if !slices.Contains(keys, liveVotes) {
+		t.Errorf("CreateKeyList(delete) did not return the computed field")
+	}
+}
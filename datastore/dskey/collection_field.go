@@ -22,3 +22,14 @@ func joinInt(i1, i2 int) uint64 {
 func ValidateCollectionField(collection, field string) bool {
 	return collectionFieldToID(fmt.Sprintf("%s/%s", collection, field)) != -1
 }
+
+// CollectionFields returns all known combinations of collection and field in
+// the form collection/field.
+func CollectionFields() []string {
+	// The first entry is the invalid key.
+	fields := make([]string, 0, len(collectionFields)-1)
+	for _, cf := range collectionFields[1:] {
+		fields = append(fields, cf.collection+"/"+cf.field)
+	}
+	return fields
+}
@@ -189,3 +189,22 @@ func TestIDField(t *testing.T) {
 		})
 	}
 }
+
+func TestCollectionFields(t *testing.T) {
+	fields := dskey.CollectionFields()
+
+	found := false
+	for _, cf := range fields {
+		if cf == "invalid/key" {
+			t.Errorf("CollectionFields contains the invalid key")
+		}
+
+		if cf == "user/username" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("CollectionFields does not contain user/username")
+	}
+}
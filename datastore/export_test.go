@@ -0,0 +1,57 @@
+package datastore
+
+import (
+	"net"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ConvertField exports convertField for tests.
+func (p *FlowPostgres) ConvertField(value []byte, fd pgconn.FieldDescription) ([]byte, error) {
+	return p.convertField(value, fd)
+}
+
+// ConvertBinaryValue exports convertBinaryValue for tests.
+func (p *FlowPostgres) ConvertBinaryValue(value []byte, oid uint32) ([]byte, error) {
+	return p.convertBinaryValue(value, oid)
+}
+
+// PostgresPoolConfig exports postgresPoolConfig for tests.
+var PostgresPoolConfig = postgresPoolConfig
+
+// ParseReplicaHosts exports parseReplicaHosts for tests. It returns the hosts
+// as host:port.
+func ParseReplicaHosts(value string, defaultPort string) ([]string, error) {
+	hosts, err := parseReplicaHosts(value, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, len(hosts))
+	for i, host := range hosts {
+		result[i] = net.JoinHostPort(host.host, host.port)
+	}
+	return result, nil
+}
+
+// ToPostgresText exports toPostgresText for tests.
+func ToPostgresText(value []byte, elementOID uint32, isArray bool) (any, error) {
+	return toPostgresText(value, writeColumn{elementOID: elementOID, isArray: isArray})
+}
+
+// CreateKeyList exports createKeyList for tests.
+var CreateKeyList = createKeyList
+
+// IsRelationTableField exports isRelationTableField for tests.
+var IsRelationTableField = isRelationTableField
+
+// RaiseLastXactID exports raiseLastXactID for tests.
+func (p *FlowPostgres) RaiseLastXactID(id uint64) {
+	p.raiseLastXactID(id)
+}
+
+// LastXactID returns the last transaction id, that has to be visible on a
+// replica.
+func (p *FlowPostgres) LastXactID() uint64 {
+	return p.lastXactID.Load()
+}
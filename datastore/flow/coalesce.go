@@ -0,0 +1,159 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+)
+
+// Coalesce is a getter middleware, that merges concurrent requests into one
+// request.
+//
+// All calls to Get, that arrive within a time window, are sent to the getter
+// as one request. Each caller only gets the keys it requested. The values are
+// not stored after the request. Use cache.Cache to store them.
+type Coalesce struct {
+	getter Getter
+	window time.Duration
+
+	mu      sync.Mutex
+	current *batch
+}
+
+// NewCoalesce initializes a Coalesce. The window is the time, the first
+// request waits for other requests.
+func NewCoalesce(getter Getter, window time.Duration) *Coalesce {
+	return &Coalesce{
+		getter: getter,
+		window: window,
+	}
+}
+
+// batch is one request to the getter, that is shared by many callers.
+type batch struct {
+	keys    map[dskey.Key]struct{}
+	waiters int
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	done chan struct{}
+	data map[dskey.Key][]byte
+	err  error
+}
+
+// Get adds the keys to the current batch and waits for the result.
+func (c *Coalesce) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	if len(keys) == 0 {
+		return map[dskey.Key][]byte{}, nil
+	}
+
+	b := c.join(ctx, keys)
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		c.leave(b)
+		return nil, ctx.Err()
+	}
+
+	var degraded *DegradedError
+	if b.err != nil && !errors.As(b.err, &degraded) {
+		return nil, b.err
+	}
+
+	data := make(map[dskey.Key][]byte, len(keys))
+	for _, key := range keys {
+		data[key] = b.data[key]
+	}
+
+	if degraded != nil {
+		return data, callerDegradedError(degraded, data)
+	}
+	return data, nil
+}
+
+// callerDegradedError returns a DegradedError with the replaced keys, that
+// are in data. It returns nil, if no key of data was replaced.
+func callerDegradedError(degraded *DegradedError, data map[dskey.Key][]byte) error {
+	var keys []dskey.Key
+	for _, key := range degraded.Keys {
+		if _, ok := data[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+	return &DegradedError{Keys: keys, Err: degraded.Err}
+}
+
+// join adds the keys to the current batch. If there is no batch, a new one is
+// created, that is sent after the window.
+func (c *Coalesce) join(ctx context.Context, keys []dskey.Key) *batch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := c.current
+	if b == nil {
+		// The values of the context are used, but the request is only
+		// canceled, when all callers are gone.
+		batchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		b = &batch{
+			keys:   make(map[dskey.Key]struct{}, len(keys)),
+			ctx:    batchCtx,
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		c.current = b
+		time.AfterFunc(c.window, func() { c.send(b) })
+	}
+
+	for _, key := range keys {
+		b.keys[key] = struct{}{}
+	}
+	b.waiters++
+	return b
+}
+
+// leave removes a caller from a batch. If it was the last caller, the request
+// is canceled.
+func (c *Coalesce) leave(b *batch) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b.waiters--
+	if b.waiters == 0 {
+		b.cancel()
+		if c.current == b {
+			// New callers must not join the canceled batch.
+			c.current = nil
+		}
+	}
+}
+
+// send closes the batch and fetches its keys.
+func (c *Coalesce) send(b *batch) {
+	c.mu.Lock()
+	if c.current == b {
+		c.current = nil
+	}
+	keys := make([]dskey.Key, 0, len(b.keys))
+	for key := range b.keys {
+		keys = append(keys, key)
+	}
+	c.mu.Unlock()
+
+	defer b.cancel()
+	defer close(b.done)
+
+	if b.ctx.Err() != nil {
+		b.err = b.ctx.Err()
+		return
+	}
+
+	b.data, b.err = c.getter.Get(b.ctx, keys...)
+}
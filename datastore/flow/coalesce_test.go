@@ -0,0 +1,131 @@
+package flow_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+func TestCoalesceMergesConcurrentRequests(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(
+		dsmock.YAMLData(`---
+		user/1/username: hugo
+		user/2/username: max
+		`),
+		func(in flow.Getter) flow.Getter { return dsmock.NewCounter(in) },
+	)
+	counter := ds.Middlewares()[0].(*dsmock.Counter)
+	coalesce := flow.NewCoalesce(ds, 50*time.Millisecond)
+
+	keys := []dskey.Key{
+		dskey.MustKey("user/1/username"),
+		dskey.MustKey("user/2/username"),
+	}
+
+	var wg sync.WaitGroup
+	results := make([]map[dskey.Key][]byte, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data, err := coalesce.Get(ctx, keys[i%2])
+			if err != nil {
+				t.Errorf("Get: %v", err)
+			}
+			results[i] = data
+		}()
+	}
+	wg.Wait()
+
+	if got := len(counter.Requests()); got != 1 {
+		t.Errorf("got %d requests, expected 1", got)
+	}
+
+	for i, data := range results {
+		if len(data) != 1 {
+			t.Errorf("request %d got %v, expected only one key", i, data)
+		}
+
+		if _, ok := data[keys[i%2]]; !ok {
+			t.Errorf("request %d got %v, expected key %s", i, data, keys[i%2])
+		}
+	}
+}
+
+func TestCoalesceCancel(t *testing.T) {
+	coalesce := flow.NewCoalesce(blockingGetter{}, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := coalesce.Get(ctx, dskey.MustKey("user/1/username")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get returned %v, expected DeadlineExceeded", err)
+	}
+
+	// A canceled request does not affect later requests.
+	ds := dsmock.NewFlow(dsmock.YAMLData(`user/1/username: hugo`))
+	coalesce = flow.NewCoalesce(ds, time.Millisecond)
+	if _, err := coalesce.Get(context.Background(), dskey.MustKey("user/1/username")); err != nil {
+		t.Errorf("Get: %v", err)
+	}
+}
+
+// degradedGetter returns the values of the getter and reports the key as
+// replaced.
+type degradedGetter struct {
+	flow.Getter
+	key dskey.Key
+}
+
+func (g degradedGetter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	data, err := g.Getter.Get(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return data, &flow.DegradedError{Keys: []dskey.Key{g.key}, Err: errors.New("source is broken")}
+}
+
+func TestCoalesceDegraded(t *testing.T) {
+	ctx := context.Background()
+
+	usernameKey := dskey.MustKey("user/1/username")
+	voteKey := dskey.MustKey("poll/1/live_votes")
+	ds := dsmock.NewFlow(dsmock.YAMLData(`user/1/username: hugo`))
+	coalesce := flow.NewCoalesce(degradedGetter{Getter: ds, key: voteKey}, 50*time.Millisecond)
+
+	var wg sync.WaitGroup
+	var usernameData, voteData map[dskey.Key][]byte
+	var usernameErr, voteErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		usernameData, usernameErr = coalesce.Get(ctx, usernameKey)
+	}()
+	go func() {
+		defer wg.Done()
+		voteData, voteErr = coalesce.Get(ctx, usernameKey, voteKey)
+	}()
+	wg.Wait()
+
+	if usernameErr != nil || string(usernameData[usernameKey]) != `"hugo"` {
+		t.Errorf("caller without replaced keys got %v, %v", usernameData, usernameErr)
+	}
+
+	var degraded *flow.DegradedError
+	if !errors.As(voteErr, &degraded) || len(degraded.Keys) != 1 || degraded.Keys[0] != voteKey {
+		t.Errorf("got error %v, expected a DegradedError for %s", voteErr, voteKey)
+	}
+
+	if string(voteData[usernameKey]) != `"hugo"` {
+		t.Errorf("caller with replaced keys got %v, expected the other values", voteData)
+	}
+}
@@ -2,48 +2,289 @@ package flow
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/OpenSlides/openslides-go/datastore/dskey"
 	"golang.org/x/sync/errgroup"
 )
 
-type combined struct {
-	defaultFlow Flow
-	otherFlows  map[string]Flow
+// defaultSourceName is the name of the default flow of a Combined flow.
+const defaultSourceName = "default"
+
+// DefaultLastKnownSize is the amount of values, that a source with
+// PolicyLastKnown remembers, if Source.LastKnownSize is 0.
+const DefaultLastKnownSize = 10_000
+
+// Policy decides what a Combined flow does, when one of its sources fails.
+//
+// With PolicyNil and PolicyLastKnown, the request does not fail. Get returns
+// the values together with a DegradedError.
+type Policy int
+
+const (
+	// PolicyFail lets the whole request fail.
+	PolicyFail Policy = iota
+
+	// PolicyNil returns nil for the keys of the failing source.
+	PolicyNil
+
+	// PolicyLastKnown returns the last value, that was received from the
+	// source. Keys, that where never received, are nil.
+	PolicyLastKnown
+)
+
+// DegradedError is returned by Combined.Get together with the values, if a
+// source failed and the values of its keys were replaced by the policy of the
+// source.
+//
+// The replaced values are not the real values. So they should not be cached.
+type DegradedError struct {
+	// Keys are the keys with replaced values.
+	Keys []dskey.Key
+
+	// Err contains the errors of the failed sources.
+	Err error
 }
 
-func (c *combined) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
-	grouped := make(map[string][]dskey.Key, len(keys))
-	for _, key := range keys {
-		if _, ok := c.otherFlows[key.CollectionField()]; ok {
-			grouped[key.CollectionField()] = append(grouped[key.CollectionField()], key)
-			continue
+func (e *DegradedError) Error() string {
+	return fmt.Sprintf("values of %d keys are replaced: %v", len(e.Keys), e.Err)
+}
+
+func (e *DegradedError) Unwrap() error {
+	return e.Err
+}
+
+// Source is a flow, that is used by a Combined flow, with its policy.
+type Source struct {
+	Flow   Flow
+	Policy Policy
+
+	// LastKnownSize is the maximum amount of values, that are remembered for
+	// PolicyLastKnown. If a new value does not fit, an arbitrary old value is
+	// forgotten. 0 means DefaultLastKnownSize.
+	LastKnownSize int
+}
+
+// SourceHealth is the health status of one source of a Combined flow.
+type SourceHealth struct {
+	// Healthy is false, if the last request or the update loop of the source
+	// failed.
+	Healthy bool
+
+	// LastError is the last error of the source.
+	LastError error
+
+	// LastErrorTime is the time of the last error.
+	LastErrorTime time.Time
+}
+
+// Route decides, which keys are fetched from a source of a Combined flow.
+//
+// A key matches the route, if it matches the pattern and the predicate. At
+// least one of them has to be set.
+type Route struct {
+	// Name is used for the health status of the source. Defaults to the
+	// pattern.
+	Name string
+
+	// Pattern is matched against the collection/field of a key with the
+	// syntax of path.Match. For example `motion/*` for a whole collection or
+	// `*/live_votes` for a field in all collections.
+	Pattern string
+
+	// Match is a predicate on the key.
+	Match func(dskey.Key) bool
+
+	Source
+}
+
+// Combined is a flow, that uses different flows for different keys.
+type Combined struct {
+	defaultSource *source
+	routes        []route
+}
+
+// route is a validated Route.
+type route struct {
+	// fields are the collection fields, that match the pattern. It is nil, if
+	// the route has no pattern.
+	fields map[string]struct{}
+	match  func(dskey.Key) bool
+	source *source
+}
+
+func (r route) matches(key dskey.Key) bool {
+	if r.fields != nil {
+		if _, ok := r.fields[key.CollectionField()]; !ok {
+			return false
 		}
+	}
 
-		grouped["default"] = append(grouped["default"], key)
+	return r.match == nil || r.match(key)
+}
+
+// Combine combines flows.
+//
+// One is used as default. The others are used when a corresponding key is called.
+//
+// If one flow fails, the whole request fails. Use CombineSources for other
+// policies.
+//
+// The keys of the map are not validated. A key, that is not a known collection
+// field, is never used. Use CombineSources to get an error instead.
+func Combine(defaultFlow Flow, keys map[string]Flow) Flow {
+	sources := make(map[string]Source, len(keys))
+	for collectionField, flow := range keys {
+		sources[collectionField] = Source{Flow: flow}
 	}
 
-	eg, ctx := errgroup.WithContext(ctx)
-	dataCh := make(chan map[dskey.Key][]byte, 1)
+	return combineSources(Source{Flow: defaultFlow}, sources)
+}
 
-	for flowName, keys := range grouped {
-		keys := keys
-		flowName := flowName
-		flow, found := c.otherFlows[flowName]
-		if !found {
-			flow = c.defaultFlow
-			flowName = "default"
+// CombineSources is like Combine, but each source has a policy, that decides
+// what happens, when the source fails.
+//
+// The keys of the map have the form collection/field. A key, that is not a
+// known collection field, returns an error.
+func CombineSources(defaultSource Source, sources map[string]Source) (*Combined, error) {
+	for collectionField := range sources {
+		collection, field, ok := strings.Cut(collectionField, "/")
+		if !ok || !dskey.ValidateCollectionField(collection, field) {
+			return nil, fmt.Errorf("unknown collection field %s", collectionField)
 		}
+	}
 
+	return combineSources(defaultSource, sources), nil
+}
+
+// combineSources is like CombineSources without validating the keys.
+func combineSources(defaultSource Source, sources map[string]Source) *Combined {
+	routes := make([]route, 0, len(sources))
+	for collectionField, s := range sources {
+		routes = append(routes, route{
+			fields: map[string]struct{}{collectionField: {}},
+			source: newSource(collectionField, s),
+		})
+	}
+
+	return &Combined{
+		defaultSource: newSource(defaultSourceName, defaultSource),
+		routes:        routes,
+	}
+}
+
+// CombineRoutes is like CombineSources, but the sources are chosen by routes.
+// The first route, that matches a key, is used. Keys, that match no route, are
+// fetched from the default source.
+//
+// The patterns are validated against the known collection fields. A pattern,
+// that matches no field, returns an error.
+func CombineRoutes(defaultSource Source, routes ...Route) (*Combined, error) {
+	names := map[string]struct{}{defaultSourceName: {}}
+	validated := make([]route, 0, len(routes))
+	for i, r := range routes {
+		if r.Pattern == "" && r.Match == nil {
+			return nil, fmt.Errorf("route %d has no pattern and no predicate", i)
+		}
+
+		name := r.Name
+		if name == "" {
+			name = r.Pattern
+		}
+
+		if name == "" {
+			return nil, fmt.Errorf("route %d needs a name", i)
+		}
+
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("route name %s is used twice", name)
+		}
+		names[name] = struct{}{}
+
+		var fields map[string]struct{}
+		if r.Pattern != "" {
+			var err error
+			fields, err = matchingCollectionFields(r.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", name, err)
+			}
+		}
+
+		validated = append(validated, route{
+			fields: fields,
+			match:  r.Match,
+			source: newSource(name, r.Source),
+		})
+	}
+
+	return &Combined{
+		defaultSource: newSource(defaultSourceName, defaultSource),
+		routes:        validated,
+	}, nil
+}
+
+// matchingCollectionFields returns all known collection fields, that match the
+// pattern.
+func matchingCollectionFields(pattern string) (map[string]struct{}, error) {
+	if strings.Count(pattern, "/") != 1 {
+		return nil, fmt.Errorf("pattern %s has to have the form collection/field", pattern)
+	}
+
+	fields := make(map[string]struct{})
+	for _, collectionField := range dskey.CollectionFields() {
+		ok, err := path.Match(pattern, collectionField)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+
+		if ok {
+			fields[collectionField] = struct{}{}
+		}
+	}
+
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("pattern %s matches no field", pattern)
+	}
+
+	return fields, nil
+}
+
+// Get fetches each key from its source.
+//
+// If a source fails, that has the policy PolicyNil or PolicyLastKnown, the
+// values are returned together with a DegradedError.
+func (c *Combined) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	grouped := make(map[*source][]dskey.Key, len(keys))
+	for _, key := range keys {
+		src := c.sourceFor(key)
+		grouped[src] = append(grouped[src], key)
+	}
+
+	type sourceResult struct {
+		values map[dskey.Key][]byte
+		err    error
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	resultCh := make(chan sourceResult, 1)
+
+	for src, keys := range grouped {
 		eg.Go(func() error {
-			values, err := flow.Get(ctx, keys...)
+			values, err := src.get(ctx, keys)
 			if err != nil {
-				return fmt.Errorf("source %s: %w", flowName, err)
+				err = fmt.Errorf("source %s: %w", src.name, err)
+				if values == nil {
+					return err
+				}
 			}
 
-			dataCh <- values
+			resultCh <- sourceResult{values: values, err: err}
 			return nil
 		})
 	}
@@ -51,13 +292,22 @@ func (c *combined) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- eg.Wait()
-		close(dataCh)
+		close(resultCh)
 	}()
 
 	result := make(map[dskey.Key][]byte, len(keys))
-	for values := range dataCh {
-		for k, v := range values {
+	var degraded DegradedError
+	var degradeErrs []error
+	for r := range resultCh {
+		for k, v := range r.values {
 			result[k] = v
+			if r.err != nil {
+				degraded.Keys = append(degraded.Keys, k)
+			}
+		}
+
+		if r.err != nil {
+			degradeErrs = append(degradeErrs, r.err)
 		}
 	}
 
@@ -65,40 +315,292 @@ func (c *combined) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]
 		return nil, err
 	}
 
+	if len(degradeErrs) > 0 {
+		degraded.Err = errors.Join(degradeErrs...)
+		return result, &degraded
+	}
+
 	return result, nil
 }
 
-func (c *combined) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
-	cancelCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+func (c *Combined) sourceFor(key dskey.Key) *source {
+	for _, r := range c.routes {
+		if r.matches(key) {
+			return r.source
+		}
+	}
+	return c.defaultSource
+}
 
-	var wg sync.WaitGroup
+// Update calls the Update method of all sources.
+//
+// If the Update method of a source returns before the context is done, it is
+// restarted after a backoff. The other sources are not affected. Update blocks
+// until the context is done.
+func (c *Combined) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
+	if updateFn == nil {
+		updateFn = func(map[dskey.Key][]byte, error) {}
+	}
 
-	wg.Add(1)
-	go func() {
-		c.defaultFlow.Update(cancelCtx, updateFn)
-		cancel()
-		wg.Done()
-	}()
+	c.UpdateFromPosition(ctx, 0, func(_ uint64, data map[dskey.Key][]byte, err error) {
+		updateFn(data, err)
+	})
+}
+
+// UpdateWithPosition is like Update, but also returns the positions of the
+// default source. Updates of the other sources have the position 0.
+func (c *Combined) UpdateWithPosition(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	c.UpdateFromPosition(ctx, 0, updateFn)
+}
+
+// UpdateFromPosition is like UpdateWithPosition, but the default source first
+// sends all updates since the position. The default source has to implement
+// Resumer. Otherwise, ErrMissedUpdates is reported.
+//
+// Only the default source is resumed. The other sources start with new
+// updates.
+func (c *Combined) UpdateFromPosition(ctx context.Context, position uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	if updateFn == nil {
+		updateFn = func(uint64, map[dskey.Key][]byte, error) {}
+	}
+
+	var wg sync.WaitGroup
+	for _, src := range c.sources() {
+		from := position
+		fn := updateFn
+		if src != c.defaultSource {
+			// The positions of the other sources do not belong to the
+			// positions of the default source.
+			from = 0
+			fn = func(_ uint64, data map[dskey.Key][]byte, err error) {
+				updateFn(0, data, err)
+			}
+		}
 
-	wg.Add(len(c.otherFlows))
-	for _, flow := range c.otherFlows {
-		go func(flow Flow) {
-			flow.Update(cancelCtx, updateFn)
-			cancel()
-			wg.Done()
-		}(flow)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			src.update(ctx, from, fn)
+		}()
 	}
 
 	wg.Wait()
 }
 
-// Combine combines flows.
+// ResumePosition returns the resume position of the default source or 0, if
+// it does not implement Resumer.
+func (c *Combined) ResumePosition() uint64 {
+	resumer, ok := c.defaultSource.flow.(Resumer)
+	if !ok {
+		return 0
+	}
+	return resumer.ResumePosition()
+}
+
+// CoversPosition calls CoversPosition of the default source.
+func (c *Combined) CoversPosition(ctx context.Context, position uint64) (bool, error) {
+	resumer, ok := c.defaultSource.flow.(Resumer)
+	if !ok {
+		return false, fmt.Errorf("default source does not support resuming")
+	}
+	return resumer.CoversPosition(ctx, position)
+}
+
+// Health returns the health status of each source. The default flow has the
+// name "default".
+func (c *Combined) Health() map[string]SourceHealth {
+	health := make(map[string]SourceHealth, len(c.routes)+1)
+	for _, src := range c.sources() {
+		health[src.name] = src.healthStatus()
+	}
+	return health
+}
+
+func (c *Combined) sources() []*source {
+	sources := make([]*source, 0, len(c.routes)+1)
+	sources = append(sources, c.defaultSource)
+	for _, r := range c.routes {
+		sources = append(sources, r.source)
+	}
+	return sources
+}
+
+// source is a flow with its policy and state.
+type source struct {
+	name   string
+	flow   Flow
+	policy Policy
+
+	mu            sync.Mutex
+	health        SourceHealth
+	lastKnown     map[dskey.Key][]byte
+	lastKnownSize int
+}
+
+func newSource(name string, s Source) *source {
+	src := &source{
+		name:   name,
+		flow:   s.Flow,
+		policy: s.Policy,
+		health: SourceHealth{Healthy: true},
+	}
+
+	if s.Policy == PolicyLastKnown {
+		src.lastKnown = make(map[dskey.Key][]byte)
+		src.lastKnownSize = s.LastKnownSize
+		if src.lastKnownSize <= 0 {
+			src.lastKnownSize = DefaultLastKnownSize
+		}
+	}
+	return src
+}
+
+// get fetches the keys from the flow and applies the policy, if it fails.
 //
-// One is used as default. The others are used when a corresponding key is called.
-func Combine(defaultFlow Flow, keys map[string]Flow) Flow {
-	return &combined{
-		defaultFlow: defaultFlow,
-		otherFlows:  keys,
+// If the values were replaced by the policy, they are returned together with
+// the error of the flow.
+func (s *source) get(ctx context.Context, keys []dskey.Key) (map[dskey.Key][]byte, error) {
+	values, err := s.flow.Get(ctx, keys...)
+	if err == nil {
+		s.succeeded(values)
+		return values, nil
 	}
+
+	if ctx.Err() != nil {
+		// The request was canceled. This is not a failure of the source.
+		return nil, err
+	}
+
+	s.failed(err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.policy {
+	case PolicyNil, PolicyLastKnown:
+		values := make(map[dskey.Key][]byte, len(keys))
+		for _, key := range keys {
+			values[key] = s.lastKnown[key]
+		}
+		return values, err
+
+	default:
+		return nil, err
+	}
+}
+
+// update runs the updates of the flow until the context is done.
+//
+// If from is not 0, the updates are resumed from this position. After a
+// restart, a flow, that implements Resumer, continues from its resume
+// position.
+func (s *source) update(ctx context.Context, from uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	var restarts int
+	for {
+		var received atomic.Bool
+		s.runUpdate(ctx, from, func(position uint64, data map[dskey.Key][]byte, err error) {
+			if err != nil {
+				s.failed(err)
+			} else {
+				received.Store(true)
+				s.updated(data)
+			}
+			updateFn(position, data, err)
+		})
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.failed(fmt.Errorf("update of source %s stopped", s.name))
+		if received.Load() {
+			restarts = 0
+		}
+		restarts++
+		if err := DefaultBackoff.Wait(ctx, restarts); err != nil {
+			return
+		}
+
+		from = 0
+		if resumer, ok := s.flow.(Resumer); ok {
+			from = resumer.ResumePosition()
+		}
+	}
+}
+
+// runUpdate calls the update method of the flow, that supports the most
+// features.
+func (s *source) runUpdate(ctx context.Context, from uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	if from != 0 {
+		if resumer, ok := s.flow.(Resumer); ok {
+			resumer.UpdateFromPosition(ctx, from, updateFn)
+			return
+		}
+
+		updateFn(0, nil, fmt.Errorf("source %s does not support resuming: %w", s.name, ErrMissedUpdates))
+	}
+
+	if positionFlow, ok := s.flow.(UpdaterWithPosition); ok {
+		positionFlow.UpdateWithPosition(ctx, updateFn)
+		return
+	}
+
+	s.flow.Update(ctx, func(data map[dskey.Key][]byte, err error) {
+		updateFn(0, data, err)
+	})
+}
+
+// succeeded marks the source as healthy and remembers the fetched values.
+func (s *source) succeeded(data map[dskey.Key][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.health.Healthy = true
+	if s.lastKnown == nil {
+		return
+	}
+
+	for key, value := range data {
+		if _, ok := s.lastKnown[key]; !ok && len(s.lastKnown) >= s.lastKnownSize {
+			for old := range s.lastKnown {
+				delete(s.lastKnown, old)
+				break
+			}
+		}
+		s.lastKnown[key] = value
+	}
+}
+
+// updated marks the source as healthy and updates the remembered values.
+//
+// Keys, that where not fetched before, are not remembered. An update can
+// contain keys of other sources.
+func (s *source) updated(data map[dskey.Key][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.health.Healthy = true
+	for key, value := range data {
+		if _, ok := s.lastKnown[key]; ok {
+			s.lastKnown[key] = value
+		}
+	}
+}
+
+func (s *source) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.health = SourceHealth{
+		Healthy:       false,
+		LastError:     err,
+		LastErrorTime: time.Now(),
+	}
+}
+
+func (s *source) healthStatus() SourceHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.health
 }
@@ -0,0 +1,366 @@
+package flow_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+// brokenFlow returns values until it is broken. Its Update returns
+// immediately.
+type brokenFlow struct {
+	flow.Getter
+	broken  atomic.Bool
+	updates atomic.Int64
+}
+
+func (f *brokenFlow) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	if f.broken.Load() {
+		return nil, errors.New("flow is broken")
+	}
+	return f.Getter.Get(ctx, keys...)
+}
+
+func (f *brokenFlow) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
+	f.updates.Add(1)
+}
+
+func TestCombinedPolicies(t *testing.T) {
+	ctx := context.Background()
+
+	defaultKey := dskey.MustKey("user/1/username")
+	voteKey := dskey.MustKey("poll/1/live_votes")
+
+	defaultFlow := dsmock.NewFlow(dsmock.YAMLData(`user/1/username: hugo`))
+
+	for _, tt := range []struct {
+		name      string
+		policy    flow.Policy
+		expectErr bool
+		expect    string
+	}{
+		{"fail", flow.PolicyFail, true, ""},
+		{"nil", flow.PolicyNil, false, ""},
+		{"last known", flow.PolicyLastKnown, false, `"votes"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			voteFlow := &brokenFlow{Getter: dsmock.Stub{voteKey: []byte(`"votes"`)}}
+			combined, err := flow.CombineSources(
+				flow.Source{Flow: defaultFlow},
+				map[string]flow.Source{"poll/live_votes": {Flow: voteFlow, Policy: tt.policy}},
+			)
+			if err != nil {
+				t.Fatalf("CombineSources: %v", err)
+			}
+
+			if _, err := combined.Get(ctx, defaultKey, voteKey); err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+
+			voteFlow.broken.Store(true)
+			got, err := combined.Get(ctx, defaultKey, voteKey)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("Get returned no error")
+				}
+				return
+			}
+
+			var degraded *flow.DegradedError
+			if !errors.As(err, &degraded) {
+				t.Fatalf("Get with broken flow returned %v, expected a DegradedError", err)
+			}
+
+			if len(degraded.Keys) != 1 || degraded.Keys[0] != voteKey {
+				t.Errorf("got degraded keys %v, expected only %s", degraded.Keys, voteKey)
+			}
+
+			if string(got[defaultKey]) != `"hugo"` {
+				t.Errorf("got %s for default key, expected hugo", got[defaultKey])
+			}
+
+			if string(got[voteKey]) != tt.expect {
+				t.Errorf("got %s for vote key, expected %s", got[voteKey], tt.expect)
+			}
+
+			health := combined.Health()
+			if health["poll/live_votes"].Healthy || !health["default"].Healthy {
+				t.Errorf("got health %v, expected only the vote source to be unhealthy", health)
+			}
+		})
+	}
+}
+
+func TestCombinedLastKnownSize(t *testing.T) {
+	ctx := context.Background()
+
+	voteKey1 := dskey.MustKey("poll/1/live_votes")
+	voteKey2 := dskey.MustKey("poll/2/live_votes")
+
+	voteFlow := &brokenFlow{Getter: dsmock.Stub{
+		voteKey1: []byte(`"votes1"`),
+		voteKey2: []byte(`"votes2"`),
+	}}
+	combined, err := flow.CombineSources(
+		flow.Source{Flow: dsmock.NewFlow(dsmock.Stub{})},
+		map[string]flow.Source{"poll/live_votes": {Flow: voteFlow, Policy: flow.PolicyLastKnown, LastKnownSize: 1}},
+	)
+	if err != nil {
+		t.Fatalf("CombineSources: %v", err)
+	}
+
+	if _, err := combined.Get(ctx, voteKey1); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if _, err := combined.Get(ctx, voteKey2); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	voteFlow.broken.Store(true)
+	got, _ := combined.Get(ctx, voteKey1, voteKey2)
+
+	// Only the last value is remembered.
+	if got[voteKey1] != nil || string(got[voteKey2]) != `"votes2"` {
+		t.Errorf("got %v, expected only the value of %s", got, voteKey2)
+	}
+}
+
+// positionFlow is a flow with positions, that can be resumed.
+type positionFlow struct {
+	*dsmock.Flow
+	resumedFrom chan uint64
+}
+
+func (f *positionFlow) UpdateWithPosition(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	f.Flow.Update(ctx, func(data map[dskey.Key][]byte, err error) {
+		updateFn(42, data, err)
+	})
+}
+
+func (f *positionFlow) ResumePosition() uint64 {
+	return 42
+}
+
+func (f *positionFlow) CoversPosition(ctx context.Context, position uint64) (bool, error) {
+	return true, nil
+}
+
+func (f *positionFlow) UpdateFromPosition(ctx context.Context, position uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	f.resumedFrom <- position
+	f.UpdateWithPosition(ctx, updateFn)
+}
+
+func TestCombinedPositions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defaultFlow := &positionFlow{Flow: dsmock.NewFlow(dsmock.Stub{}), resumedFrom: make(chan uint64, 1)}
+	voteFlow := &positionFlow{Flow: dsmock.NewFlow(dsmock.Stub{}), resumedFrom: make(chan uint64, 1)}
+
+	combined, err := flow.CombineSources(
+		flow.Source{Flow: defaultFlow},
+		map[string]flow.Source{"poll/live_votes": {Flow: voteFlow}},
+	)
+	if err != nil {
+		t.Fatalf("CombineSources: %v", err)
+	}
+
+	if got := combined.ResumePosition(); got != 42 {
+		t.Errorf("ResumePosition() = %d, expected 42", got)
+	}
+
+	type update struct {
+		position uint64
+		data     map[dskey.Key][]byte
+	}
+	received := make(chan update, 1)
+	go combined.UpdateFromPosition(ctx, 21, func(position uint64, data map[dskey.Key][]byte, err error) {
+		received <- update{position: position, data: data}
+	})
+
+	if got := <-defaultFlow.resumedFrom; got != 21 {
+		t.Errorf("default flow was resumed from %d, expected 21", got)
+	}
+
+	defaultKey := dskey.MustKey("user/1/username")
+	defaultFlow.Send(map[dskey.Key][]byte{defaultKey: []byte(`"hugo"`)})
+	if got := <-received; got.position != 42 {
+		t.Errorf("update of the default flow has position %d, expected 42", got.position)
+	}
+
+	// The positions of other sources are not forwarded.
+	voteKey := dskey.MustKey("poll/1/live_votes")
+	voteFlow.Send(map[dskey.Key][]byte{voteKey: []byte(`"votes"`)})
+	if got := <-received; got.position != 0 {
+		t.Errorf("update of the vote flow has position %d, expected 0", got.position)
+	}
+
+	select {
+	case <-voteFlow.resumedFrom:
+		t.Errorf("vote flow was resumed")
+	default:
+	}
+}
+
+func TestCombinedRestartsUpdate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	defaultFlow := dsmock.NewFlow(dsmock.Stub{})
+	voteFlow := &brokenFlow{Getter: dsmock.Stub{}}
+
+	combined, err := flow.CombineSources(
+		flow.Source{Flow: defaultFlow},
+		map[string]flow.Source{"poll/live_votes": {Flow: voteFlow}},
+	)
+	if err != nil {
+		t.Fatalf("CombineSources: %v", err)
+	}
+
+	received := make(chan map[dskey.Key][]byte, 1)
+	go combined.Update(ctx, func(data map[dskey.Key][]byte, err error) {
+		received <- data
+	})
+
+	// The update of the default flow still works.
+	key := dskey.MustKey("user/1/username")
+	defaultFlow.Send(map[dskey.Key][]byte{key: []byte(`"hugo"`)})
+
+	select {
+	case got := <-received:
+		if string(got[key]) != `"hugo"` {
+			t.Errorf("got %v, expected the update of the default flow", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("update was not received")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for voteFlow.updates.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("update of the vote flow was not restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if combined.Health()["poll/live_votes"].Healthy {
+		t.Errorf("vote source is healthy, expected unhealthy")
+	}
+}
+
+func TestCombineRoutes(t *testing.T) {
+	ctx := context.Background()
+
+	data := dsmock.YAMLData(`---
+	user/1/username: hugo
+	user/200/username: max
+	motion/1/title: title
+	poll/1/live_votes: votes
+	`)
+
+	newFlow := func(name string) flow.Flow {
+		values := make(dsmock.Stub, len(data))
+		for key := range data {
+			values[key] = []byte(name)
+		}
+		return dsmock.NewFlow(values)
+	}
+
+	combined, err := flow.CombineRoutes(
+		flow.Source{Flow: newFlow("default")},
+		flow.Route{Pattern: "motion/*", Source: flow.Source{Flow: newFlow("motion")}},
+		flow.Route{Pattern: "*/live_votes", Source: flow.Source{Flow: newFlow("vote")}},
+		flow.Route{
+			Name:   "big ids",
+			Match:  func(key dskey.Key) bool { return key.ID() > 100 },
+			Source: flow.Source{Flow: newFlow("big")},
+		},
+	)
+	if err != nil {
+		t.Fatalf("CombineRoutes: %v", err)
+	}
+
+	got, err := combined.Get(ctx,
+		dskey.MustKey("user/1/username"),
+		dskey.MustKey("user/200/username"),
+		dskey.MustKey("motion/1/title"),
+		dskey.MustKey("poll/1/live_votes"),
+	)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	for key, expect := range map[string]string{
+		"user/1/username":   "default",
+		"user/200/username": "big",
+		"motion/1/title":    "motion",
+		"poll/1/live_votes": "vote",
+	} {
+		if string(got[dskey.MustKey(key)]) != expect {
+			t.Errorf("%s was fetched from %s, expected %s", key, got[dskey.MustKey(key)], expect)
+		}
+	}
+
+	health := combined.Health()
+	for _, name := range []string{"default", "motion/*", "*/live_votes", "big ids"} {
+		if _, ok := health[name]; !ok {
+			t.Errorf("no health status for %s", name)
+		}
+	}
+}
+
+func TestCombineRoutesInvalid(t *testing.T) {
+	source := flow.Source{Flow: dsmock.NewFlow(nil)}
+
+	for _, tt := range []struct {
+		name  string
+		route flow.Route
+	}{
+		{"unknown collection", flow.Route{Pattern: "motoin/*", Source: source}},
+		{"unknown field", flow.Route{Pattern: "motion/titel", Source: source}},
+		{"invalid pattern", flow.Route{Pattern: "motion/[", Source: source}},
+		{"no collection", flow.Route{Pattern: "title", Source: source}},
+		{"no pattern and predicate", flow.Route{Name: "empty", Source: source}},
+		{"duplicate name", flow.Route{Name: "default", Pattern: "motion/*", Source: source}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := flow.CombineRoutes(source, tt.route); err == nil {
+				t.Errorf("CombineRoutes returned no error")
+			}
+		})
+	}
+}
+
+func TestCombineSourcesInvalid(t *testing.T) {
+	source := flow.Source{Flow: dsmock.NewFlow(nil)}
+
+	for _, collectionField := range []string{"motoin/title", "motion/titel", "motion/*", "title"} {
+		t.Run(collectionField, func(t *testing.T) {
+			if _, err := flow.CombineSources(source, map[string]flow.Source{collectionField: source}); err == nil {
+				t.Errorf("CombineSources returned no error")
+			}
+		})
+	}
+}
+
+func TestCombineIgnoresUnknownField(t *testing.T) {
+	ds := dsmock.NewFlow(dsmock.YAMLData(`motion/1/title: hello`))
+	combined := flow.Combine(ds, map[string]flow.Flow{"motion/titel": dsmock.NewFlow(nil)})
+
+	key := dskey.MustKey("motion/1/title")
+	got, err := combined.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if string(got[key]) != `"hello"` {
+		t.Errorf("got %s, expected the value of the default flow", got[key])
+	}
+}
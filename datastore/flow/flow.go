@@ -2,10 +2,16 @@ package flow
 
 import (
 	"context"
+	"errors"
 
 	"github.com/OpenSlides/openslides-go/datastore/dskey"
 )
 
+// ErrMissedUpdates is reported by an Updater, when some updates were lost and
+// it is not possible to tell, which keys were changed. All values, that were
+// received before, could be outdated.
+var ErrMissedUpdates = errors.New("updates were missed")
+
 // Getter implements the Get function to fetch keys.
 type Getter interface {
 	Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error)
@@ -17,6 +23,35 @@ type Updater interface {
 	Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error))
 }
 
+// UpdaterWithPosition is like Updater, but the callback also gets the position
+// of the data.
+//
+// The position is the id of the database transaction, that created the
+// update. A position always means, that the changes of this transaction are
+// contained in the values. It can be used with a getter that supports
+// positions, to make sure, that a value is not older then a specific update.
+type UpdaterWithPosition interface {
+	UpdateWithPosition(ctx context.Context, updateFn func(position uint64, data map[dskey.Key][]byte, err error))
+}
+
+// Resumer is an UpdaterWithPosition, that can continue the updates of an
+// earlier run. For example after a restart with a persisted cache.
+type Resumer interface {
+	UpdaterWithPosition
+
+	// ResumePosition returns the position, from which the updates can be
+	// continued. All updates before this position were already sent.
+	ResumePosition() uint64
+
+	// CoversPosition returns true, if the updates since the position can still
+	// be sent.
+	CoversPosition(ctx context.Context, position uint64) (bool, error)
+
+	// UpdateFromPosition is like UpdateWithPosition, but first sends all
+	// updates since the position.
+	UpdateFromPosition(ctx context.Context, position uint64, updateFn func(position uint64, data map[dskey.Key][]byte, err error))
+}
+
 // Flow combines a Getter with an Updater.
 //
 // It represents data that can be fetched and gets updated.
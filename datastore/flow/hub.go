@@ -0,0 +1,308 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+)
+
+// ErrUnsubscribed is returned by Subscription.Next, after the subscription was
+// closed.
+var ErrUnsubscribed = errors.New("subscription is closed")
+
+// ErrHubStopped is returned by Subscription.Next, after Hub.Run has returned.
+var ErrHubStopped = errors.New("hub stopped")
+
+// Hub runs the Update loop of a flow and sends the changes to many
+// subscriptions.
+//
+// Each subscription only gets the changes of its keys. A slow subscriber does
+// not block the hub or other subscribers. Changes, that where not received
+// yet, are merged, so a subscriber only gets the newest value of each key.
+//
+// A new Hub has to be created with NewHub. Hub.Run has to be called to receive
+// changes.
+type Hub struct {
+	flow Flow
+
+	mu      sync.Mutex
+	byKey   map[dskey.Key]map[*Subscription]struct{}
+	all     map[*Subscription]struct{}
+	stopped bool
+}
+
+// NewHub initializes a Hub.
+func NewHub(flow Flow) *Hub {
+	return &Hub{
+		flow:  flow,
+		byKey: make(map[dskey.Key]map[*Subscription]struct{}),
+		all:   make(map[*Subscription]struct{}),
+	}
+}
+
+// Get fetches the keys from the flow.
+func (h *Hub) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	return h.flow.Get(ctx, keys...)
+}
+
+// Run calls the Update method of the flow and sends the changes to the
+// subscriptions. It blocks until the context is done or the flow stops.
+//
+// Errors from the flow are sent to all subscriptions. When Run returns, all
+// subscriptions get ErrHubStopped.
+func (h *Hub) Run(ctx context.Context) {
+	h.mu.Lock()
+	h.stopped = false
+	h.mu.Unlock()
+
+	h.flow.Update(ctx, h.publish)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stopped = true
+	for sub := range h.all {
+		sub.setStopped()
+	}
+}
+
+func (h *Hub) publish(data map[dskey.Key][]byte, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err != nil {
+		for sub := range h.all {
+			sub.sendErr(err)
+		}
+		return
+	}
+
+	changes := make(map[*Subscription]map[dskey.Key][]byte)
+	for key, value := range data {
+		for sub := range h.byKey[key] {
+			if changes[sub] == nil {
+				changes[sub] = make(map[dskey.Key][]byte)
+			}
+			changes[sub][key] = value
+		}
+	}
+
+	for sub, subData := range changes {
+		sub.send(subData)
+	}
+}
+
+// Subscribe creates a subscription for the keys.
+//
+// The subscription is closed, when the context is done or Close is called.
+func (h *Hub) Subscribe(ctx context.Context, keys ...dskey.Key) *Subscription {
+	sub := &Subscription{
+		hub:    h,
+		keys:   make(map[dskey.Key]struct{}, len(keys)),
+		signal: make(chan struct{}, 1),
+	}
+
+	h.mu.Lock()
+	h.all[sub] = struct{}{}
+	h.addKeys(sub, keys)
+	if h.stopped {
+		sub.setStopped()
+	}
+	h.mu.Unlock()
+
+	sub.stop = context.AfterFunc(ctx, sub.unsubscribe)
+	return sub
+}
+
+// addKeys registers keys for a subscription. Has to be called with the lock.
+func (h *Hub) addKeys(sub *Subscription, keys []dskey.Key) {
+	for _, key := range keys {
+		if h.byKey[key] == nil {
+			h.byKey[key] = make(map[*Subscription]struct{})
+		}
+		h.byKey[key][sub] = struct{}{}
+		sub.keys[key] = struct{}{}
+	}
+}
+
+// removeKeys unregisters keys of a subscription. Has to be called with the
+// lock.
+func (h *Hub) removeKeys(sub *Subscription, keys []dskey.Key) {
+	for _, key := range keys {
+		delete(h.byKey[key], sub)
+		if len(h.byKey[key]) == 0 {
+			delete(h.byKey, key)
+		}
+		delete(sub.keys, key)
+	}
+}
+
+// Subscription receives the changes of some keys from a Hub.
+type Subscription struct {
+	hub  *Hub
+	stop func() bool
+
+	// keys is protected by the mutex of the hub.
+	keys map[dskey.Key]struct{}
+
+	mu      sync.Mutex
+	changed map[dskey.Key][]byte
+	err     error
+	closed  bool
+	stopped bool
+	signal  chan struct{}
+}
+
+// send merges data into the changes, that where not received yet.
+func (s *Subscription) send(data map[dskey.Key][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.changed == nil {
+		s.changed = data
+	} else {
+		for key, value := range data {
+			s.changed[key] = value
+		}
+	}
+	s.notify()
+}
+
+func (s *Subscription) sendErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+	s.notify()
+}
+
+// setStopped tells the subscription, that the hub does not send changes
+// anymore.
+func (s *Subscription) setStopped() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	s.notify()
+}
+
+// notify wakes up Next. Has to be called with the lock.
+func (s *Subscription) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Next blocks until there are changes for the keys of the subscription and
+// returns them.
+//
+// If the flow returned an error, it is returned after the changes, that where
+// received before. If the flow reported ErrMissedUpdates, all values of the
+// subscription could be outdated.
+//
+// After the subscription was closed, ErrUnsubscribed is returned. After Hub.Run
+// has returned, ErrHubStopped is returned.
+func (s *Subscription) Next(ctx context.Context) (map[dskey.Key][]byte, error) {
+	for {
+		s.mu.Lock()
+		if s.changed != nil {
+			data := s.changed
+			s.changed = nil
+			s.mu.Unlock()
+			return data, nil
+		}
+
+		if s.err != nil {
+			err := s.err
+			s.err = nil
+			s.mu.Unlock()
+			return nil, err
+		}
+
+		if s.closed {
+			s.mu.Unlock()
+			return nil, ErrUnsubscribed
+		}
+
+		if s.stopped {
+			s.mu.Unlock()
+			return nil, ErrHubStopped
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.signal:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Keys returns the keys of the subscription.
+func (s *Subscription) Keys() []dskey.Key {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	keys := make([]dskey.Key, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// SetKeys replaces the keys of the subscription.
+//
+// Changes of removed keys, that where not received yet, are still returned by
+// Next. SetKeys does nothing, if the subscription is closed.
+func (s *Subscription) SetKeys(keys ...dskey.Key) {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	if _, ok := s.hub.all[s]; !ok {
+		return
+	}
+
+	newKeys := make(map[dskey.Key]struct{}, len(keys))
+	for _, key := range keys {
+		newKeys[key] = struct{}{}
+	}
+
+	var removed []dskey.Key
+	for key := range s.keys {
+		if _, ok := newKeys[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	s.hub.removeKeys(s, removed)
+	s.hub.addKeys(s, keys)
+}
+
+// Close removes the subscription from the hub. Changes, that where not
+// received, are dropped.
+func (s *Subscription) Close() {
+	s.stop()
+	s.unsubscribe()
+}
+
+func (s *Subscription) unsubscribe() {
+	s.hub.mu.Lock()
+	delete(s.hub.all, s)
+	keys := make([]dskey.Key, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	s.hub.removeKeys(s, keys)
+	s.hub.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.changed = nil
+	s.err = nil
+	s.notify()
+}
@@ -0,0 +1,154 @@
+package flow_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+func TestHubSendsOnlySubscribedKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.NewFlow(dsmock.Stub{})
+	hub := flow.NewHub(ds)
+	go hub.Run(ctx)
+
+	userKey := dskey.MustKey("user/1/username")
+	motionKey := dskey.MustKey("motion/1/title")
+
+	userSub := hub.Subscribe(ctx, userKey)
+	motionSub := hub.Subscribe(ctx, motionKey)
+
+	ds.Send(map[dskey.Key][]byte{userKey: []byte(`"hugo"`)})
+	ds.Send(map[dskey.Key][]byte{motionKey: []byte(`"title"`)})
+
+	got, err := userSub.Next(ctx)
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+
+	if len(got) != 1 || string(got[userKey]) != `"hugo"` {
+		t.Errorf("user subscription got %v", got)
+	}
+
+	got, err = motionSub.Next(ctx)
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+
+	if len(got) != 1 || string(got[motionKey]) != `"title"` {
+		t.Errorf("motion subscription got %v", got)
+	}
+}
+
+func TestHubMergesChangesOfSlowSubscribers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.NewFlow(dsmock.Stub{})
+	hub := flow.NewHub(ds)
+	go hub.Run(ctx)
+
+	key := dskey.MustKey("user/1/username")
+	sub := hub.Subscribe(ctx, key)
+
+	// Send blocks until the hub received the value. So the hub does not wait
+	// for the subscriber.
+	ds.Send(map[dskey.Key][]byte{key: []byte(`"first"`)})
+	ds.Send(map[dskey.Key][]byte{key: []byte(`"second"`)})
+	ds.Send(map[dskey.Key][]byte{key: []byte(`"third"`)})
+
+	// Wait until the last value was published.
+	var got map[dskey.Key][]byte
+	for string(got[key]) != `"third"` {
+		data, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		got = data
+	}
+}
+
+func TestHubUnsubscribesOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := dsmock.NewFlow(dsmock.Stub{})
+	hub := flow.NewHub(ds)
+	go hub.Run(ctx)
+
+	key := dskey.MustKey("user/1/username")
+	subCtx, subCancel := context.WithCancel(ctx)
+	sub := hub.Subscribe(subCtx, key)
+	subCancel()
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(ctx, time.Second)
+	defer timeoutCancel()
+
+	if _, err := sub.Next(timeoutCtx); !errors.Is(err, flow.ErrUnsubscribed) {
+		t.Errorf("Next returned %v, expected ErrUnsubscribed", err)
+	}
+
+	if keys := sub.Keys(); len(keys) != 0 {
+		t.Errorf("subscription still has keys %v", keys)
+	}
+}
+
+type errorFlow struct {
+	flow.Getter
+	err error
+}
+
+func (f errorFlow) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
+	updateFn(nil, f.err)
+	<-ctx.Done()
+}
+
+func TestHubSendsErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := flow.NewHub(errorFlow{Getter: dsmock.Stub(nil), err: flow.ErrMissedUpdates})
+	sub := hub.Subscribe(ctx, dskey.MustKey("user/1/username"))
+	go hub.Run(ctx)
+
+	if _, err := sub.Next(ctx); !errors.Is(err, flow.ErrMissedUpdates) {
+		t.Errorf("Next returned %v, expected ErrMissedUpdates", err)
+	}
+}
+
+func TestHubStopsSubscriptions(t *testing.T) {
+	hubCtx, hubCancel := context.WithCancel(context.Background())
+
+	hub := flow.NewHub(dsmock.NewFlow(dsmock.Stub{}))
+	sub := hub.Subscribe(context.Background(), dskey.MustKey("user/1/username"))
+	defer sub.Close()
+
+	done := make(chan struct{})
+	go func() {
+		hub.Run(hubCtx)
+		close(done)
+	}()
+	hubCancel()
+	<-done
+
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), time.Second)
+	defer timeoutCancel()
+
+	if _, err := sub.Next(timeoutCtx); !errors.Is(err, flow.ErrHubStopped) {
+		t.Errorf("Next returned %v, expected ErrHubStopped", err)
+	}
+
+	late := hub.Subscribe(context.Background())
+	defer late.Close()
+
+	if _, err := late.Next(timeoutCtx); !errors.Is(err, flow.ErrHubStopped) {
+		t.Errorf("Next of a subscription after Run returned %v, expected ErrHubStopped", err)
+	}
+}
@@ -0,0 +1,311 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/oslog"
+)
+
+// Tracer starts spans for requests. It can be implemented with OpenTelemetry.
+// See the package otelflow.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is one traced request.
+type Span interface {
+	// SetAttribute adds information to the span. The value is an int, a
+	// string or a slice of strings.
+	SetAttribute(key string, value any)
+
+	// RecordError marks the span as failed.
+	RecordError(err error)
+
+	// End finishes the span.
+	End()
+}
+
+// Instrument is a getter middleware, that measures the requests to the getter.
+//
+// It counts the requested keys and errors and measures the latency of the
+// requests for each collection. If a tracer is given, each request creates a
+// span.
+//
+// If the getter is also an Updater, the updates are counted. The positions of
+// an UpdaterWithPosition and the methods of a Resumer are forwarded.
+type Instrument struct {
+	name   string
+	getter Getter
+	tracer Tracer
+
+	mu          sync.Mutex
+	requests    uint64
+	errors      uint64
+	keys        uint64
+	duration    time.Duration
+	collections map[string]*collectionLatency
+	updates     uint64
+	updateErrs  uint64
+	updatedKeys uint64
+}
+
+type collectionLatency struct {
+	requests uint64
+	errors   uint64
+	keys     uint64
+	duration time.Duration
+}
+
+// NewInstrument initializes an Instrument. The name is used for the spans and
+// the metric. The tracer can be nil.
+func NewInstrument(name string, getter Getter, tracer Tracer) *Instrument {
+	return &Instrument{
+		name:        name,
+		getter:      getter,
+		tracer:      tracer,
+		collections: make(map[string]*collectionLatency),
+	}
+}
+
+// Get calls the getter and measures the request.
+func (i *Instrument) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	keysPerCollection := make(map[string]int)
+	for _, key := range keys {
+		keysPerCollection[key.Collection()]++
+	}
+
+	var span Span
+	if i.tracer != nil {
+		ctx, span = i.tracer.Start(ctx, i.name+".Get")
+		defer span.End()
+
+		collections := make([]string, 0, len(keysPerCollection))
+		for collection := range keysPerCollection {
+			collections = append(collections, collection)
+		}
+		sort.Strings(collections)
+
+		span.SetAttribute("datastore.keys", len(keys))
+		span.SetAttribute("datastore.collections", collections)
+	}
+
+	start := time.Now()
+	data, err := i.getter.Get(ctx, keys...)
+	duration := time.Since(start)
+
+	if err != nil && span != nil {
+		span.RecordError(err)
+	}
+
+	i.record(keysPerCollection, len(keys), duration, err)
+	return data, err
+}
+
+// record adds a request to the counters. The duration is added to each
+// collection of the request.
+func (i *Instrument) record(keysPerCollection map[string]int, keyCount int, duration time.Duration, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.requests++
+	i.keys += uint64(keyCount)
+	i.duration += duration
+	if err != nil {
+		i.errors++
+	}
+
+	for collection, count := range keysPerCollection {
+		latency := i.collections[collection]
+		if latency == nil {
+			latency = new(collectionLatency)
+			i.collections[collection] = latency
+		}
+
+		latency.requests++
+		latency.keys += uint64(count)
+		latency.duration += duration
+		if err != nil {
+			latency.errors++
+		}
+	}
+}
+
+// Update calls the Update method of the getter and counts the updates. If the
+// getter is not an Updater, it blocks until the context is done.
+func (i *Instrument) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
+	if updateFn == nil {
+		updateFn = func(map[dskey.Key][]byte, error) {}
+	}
+
+	if _, ok := i.getter.(UpdaterWithPosition); ok {
+		i.UpdateWithPosition(ctx, func(_ uint64, data map[dskey.Key][]byte, err error) {
+			updateFn(data, err)
+		})
+		return
+	}
+
+	updater, ok := i.getter.(Updater)
+	if !ok {
+		<-ctx.Done()
+		return
+	}
+
+	updater.Update(ctx, func(data map[dskey.Key][]byte, err error) {
+		i.recordUpdate(data, err)
+		updateFn(data, err)
+	})
+}
+
+// UpdateWithPosition is like Update, but also returns the positions of the
+// getter. If the getter is only an Updater, the position is 0.
+func (i *Instrument) UpdateWithPosition(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	if updateFn == nil {
+		updateFn = func(uint64, map[dskey.Key][]byte, error) {}
+	}
+
+	updater, ok := i.getter.(UpdaterWithPosition)
+	if !ok {
+		i.Update(ctx, func(data map[dskey.Key][]byte, err error) {
+			updateFn(0, data, err)
+		})
+		return
+	}
+
+	updater.UpdateWithPosition(ctx, func(position uint64, data map[dskey.Key][]byte, err error) {
+		i.recordUpdate(data, err)
+		updateFn(position, data, err)
+	})
+}
+
+// UpdateFromPosition calls UpdateFromPosition of the getter and counts the
+// updates. If the getter is not a Resumer, ErrMissedUpdates is reported and
+// only new updates are sent.
+func (i *Instrument) UpdateFromPosition(ctx context.Context, position uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	if updateFn == nil {
+		updateFn = func(uint64, map[dskey.Key][]byte, error) {}
+	}
+
+	resumer, ok := i.getter.(Resumer)
+	if !ok {
+		if position != 0 {
+			updateFn(0, nil, ErrMissedUpdates)
+		}
+		i.UpdateWithPosition(ctx, updateFn)
+		return
+	}
+
+	resumer.UpdateFromPosition(ctx, position, func(position uint64, data map[dskey.Key][]byte, err error) {
+		i.recordUpdate(data, err)
+		updateFn(position, data, err)
+	})
+}
+
+// ResumePosition returns the resume position of the getter or 0, if it does
+// not implement Resumer.
+func (i *Instrument) ResumePosition() uint64 {
+	resumer, ok := i.getter.(Resumer)
+	if !ok {
+		return 0
+	}
+	return resumer.ResumePosition()
+}
+
+// CoversPosition calls CoversPosition of the getter.
+func (i *Instrument) CoversPosition(ctx context.Context, position uint64) (bool, error) {
+	resumer, ok := i.getter.(Resumer)
+	if !ok {
+		return false, fmt.Errorf("getter does not support resuming")
+	}
+	return resumer.CoversPosition(ctx, position)
+}
+
+// recordUpdate adds an update to the counters.
+func (i *Instrument) recordUpdate(data map[dskey.Key][]byte, err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.updates++
+	i.updatedKeys += uint64(len(data))
+	if err != nil {
+		i.updateErrs++
+	}
+}
+
+// InstrumentStats contains the measurements of an Instrument.
+type InstrumentStats struct {
+	// Flow is the name of the Instrument.
+	Flow string `json:"flow"`
+
+	Requests       uint64        `json:"requests"`
+	Errors         uint64        `json:"errors"`
+	Keys           uint64        `json:"keys"`
+	AverageLatency time.Duration `json:"average_latency_ns"`
+
+	Updates      uint64 `json:"updates"`
+	UpdateErrors uint64 `json:"update_errors"`
+	UpdatedKeys  uint64 `json:"updated_keys"`
+
+	// Collections contains the measurements of each collection. A request with
+	// keys of many collections is counted for each of them.
+	Collections map[string]CollectionLatency `json:"collections"`
+}
+
+// CollectionLatency contains the measurements of one collection.
+type CollectionLatency struct {
+	Requests uint64 `json:"requests"`
+	Errors   uint64 `json:"errors"`
+	Keys     uint64 `json:"keys"`
+
+	// AverageRequestLatency is the average latency of the whole requests, that
+	// contained keys of the collection. It is not the latency of the keys of
+	// the collection alone.
+	AverageRequestLatency time.Duration `json:"average_request_latency_ns"`
+}
+
+// Stats returns the measurements since the Instrument was created.
+func (i *Instrument) Stats() InstrumentStats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	stats := InstrumentStats{
+		Flow:           i.name,
+		Requests:       i.requests,
+		Errors:         i.errors,
+		Keys:           i.keys,
+		AverageLatency: average(i.duration, i.requests),
+		Updates:        i.updates,
+		UpdateErrors:   i.updateErrs,
+		UpdatedKeys:    i.updatedKeys,
+		Collections:    make(map[string]CollectionLatency, len(i.collections)),
+	}
+
+	for collection, latency := range i.collections {
+		stats.Collections[collection] = CollectionLatency{
+			Requests:              latency.requests,
+			Errors:                latency.errors,
+			Keys:                  latency.keys,
+			AverageRequestLatency: average(latency.duration, latency.requests),
+		}
+	}
+
+	return stats
+}
+
+func average(duration time.Duration, count uint64) time.Duration {
+	if count == 0 {
+		return 0
+	}
+	return duration / time.Duration(count)
+}
+
+// JSON returns the stats as json object with the name datastore_flow. It can
+// be logged with oslog.Metric.
+func (s InstrumentStats) JSON() (json.RawMessage, error) {
+	return oslog.MetricJSON("datastore_flow", s)
+}
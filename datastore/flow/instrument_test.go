@@ -0,0 +1,147 @@
+package flow_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+type testSpan struct {
+	name       string
+	attributes map[string]any
+	err        error
+	ended      bool
+}
+
+func (s *testSpan) SetAttribute(key string, value any) { s.attributes[key] = value }
+func (s *testSpan) RecordError(err error)              { s.err = err }
+func (s *testSpan) End()                               { s.ended = true }
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, flow.Span) {
+	span := &testSpan{name: name, attributes: make(map[string]any)}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func TestInstrument(t *testing.T) {
+	ctx := context.Background()
+
+	ds := dsmock.NewFlow(dsmock.YAMLData(`---
+	user/1/username: hugo
+	user/2/username: max
+	motion/1/title: title
+	`))
+
+	tracer := &testTracer{}
+	instrument := flow.NewInstrument("postgres", ds, tracer)
+
+	if _, err := instrument.Get(ctx,
+		dskey.MustKey("user/1/username"),
+		dskey.MustKey("user/2/username"),
+		dskey.MustKey("motion/1/title"),
+	); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if _, err := instrument.Get(ctx, dskey.MustKey("user/1/username")); err != nil {
+		t.Fatalf("second Get: %v", err)
+	}
+
+	stats := instrument.Stats()
+	if stats.Requests != 2 || stats.Keys != 4 || stats.Errors != 0 {
+		t.Errorf("got %d requests with %d keys and %d errors, expected 2, 4 and 0", stats.Requests, stats.Keys, stats.Errors)
+	}
+
+	if got := stats.Collections["user"]; got.Requests != 2 || got.Keys != 3 {
+		t.Errorf("got user stats %v, expected 2 requests with 3 keys", got)
+	}
+
+	if got := stats.Collections["motion"]; got.Requests != 1 || got.Keys != 1 {
+		t.Errorf("got motion stats %v, expected 1 request with 1 key", got)
+	}
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("got %d spans, expected 2", len(tracer.spans))
+	}
+
+	span := tracer.spans[0]
+	if span.name != "postgres.Get" || !span.ended || span.attributes["datastore.keys"] != 3 {
+		t.Errorf("got span %v", span)
+	}
+
+	encoded, err := stats.JSON()
+	if err != nil {
+		t.Fatalf("JSON: %v", err)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("decoding json: %v", err)
+	}
+
+	if decoded["name"] != "datastore_flow" || decoded["flow"] != "postgres" {
+		t.Errorf("got json %s", encoded)
+	}
+}
+
+type errGetter struct{}
+
+func (errGetter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	return nil, errors.New("broken")
+}
+
+func TestInstrumentError(t *testing.T) {
+	tracer := &testTracer{}
+	instrument := flow.NewInstrument("broken", errGetter{}, tracer)
+
+	if _, err := instrument.Get(context.Background(), dskey.MustKey("user/1/username")); err == nil {
+		t.Fatalf("Get returned no error")
+	}
+
+	if got := instrument.Stats().Collections["user"].Errors; got != 1 {
+		t.Errorf("got %d errors, expected 1", got)
+	}
+
+	if tracer.spans[0].err == nil {
+		t.Errorf("error was not recorded in the span")
+	}
+}
+
+func TestInstrumentPositions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := &positionFlow{Flow: dsmock.NewFlow(dsmock.Stub{}), resumedFrom: make(chan uint64, 1)}
+	instrument := flow.NewInstrument("postgres", ds, nil)
+
+	if got := instrument.ResumePosition(); got != 42 {
+		t.Errorf("ResumePosition() = %d, expected 42", got)
+	}
+
+	received := make(chan uint64, 1)
+	go instrument.UpdateFromPosition(ctx, 21, func(position uint64, data map[dskey.Key][]byte, err error) {
+		received <- position
+	})
+
+	if got := <-ds.resumedFrom; got != 21 {
+		t.Errorf("getter was resumed from %d, expected 21", got)
+	}
+
+	ds.Send(map[dskey.Key][]byte{dskey.MustKey("user/1/username"): []byte(`"hugo"`)})
+	if got := <-received; got != 42 {
+		t.Errorf("got position %d, expected 42", got)
+	}
+
+	if got := instrument.Stats().Updates; got != 1 {
+		t.Errorf("got %d updates, expected 1", got)
+	}
+}
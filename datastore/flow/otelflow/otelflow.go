@@ -0,0 +1,60 @@
+// Package otelflow connects the flow.Instrument middleware with OpenTelemetry.
+package otelflow
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer returns a flow.Tracer, that creates OpenTelemetry spans.
+//
+// Use it with flow.NewInstrument:
+//
+//	getter := flow.NewInstrument("postgres", postgres, otelflow.Tracer(otel.Tracer("datastore")))
+func Tracer(tracer trace.Tracer) flow.Tracer {
+	return otelTracer{tracer: tracer}
+}
+
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func (t otelTracer) Start(ctx context.Context, name string) (context.Context, flow.Span) {
+	ctx, span := t.tracer.Start(ctx, name)
+	return ctx, otelSpan{span: span}
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetAttribute(key string, value any) {
+	s.span.SetAttributes(toAttribute(key, value))
+}
+
+func (s otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
+
+func toAttribute(key string, value any) attribute.KeyValue {
+	switch v := value.(type) {
+	case int:
+		return attribute.Int(key, v)
+	case string:
+		return attribute.String(key, v)
+	case []string:
+		return attribute.StringSlice(key, v)
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
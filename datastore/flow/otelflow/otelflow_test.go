@@ -0,0 +1,21 @@
+package otelflow_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+	"github.com/OpenSlides/openslides-go/datastore/flow/otelflow"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTracer(t *testing.T) {
+	tracer := otelflow.Tracer(noop.NewTracerProvider().Tracer("test"))
+	instrument := flow.NewInstrument("test", dsmock.NewFlow(nil), tracer)
+
+	if _, err := instrument.Get(context.Background(), dskey.MustKey("user/1/username")); err != nil {
+		t.Errorf("Get: %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+)
+
+// ErrCircuitOpen is returned by a CircuitBreaker, when the underlying getter
+// failed too often.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// WithMiddlewares wraps the Get method of a flow with middlewares. The Update
+// method is not changed. The positions of an UpdaterWithPosition and the
+// methods of a Resumer are forwarded.
+//
+// The first middleware is called last, the same as in dsmock.NewFlow:
+//
+//	f := flow.WithMiddlewares(
+//		postgres,
+//		func(g flow.Getter) flow.Getter { return flow.NewTimeout(g, time.Second) },
+//		func(g flow.Getter) flow.Getter { return flow.NewRetry(g, 3, flow.DefaultBackoff) },
+//	)
+func WithMiddlewares(flow Flow, middlewares ...func(Getter) Getter) Flow {
+	getter := Getter(flow)
+	for _, m := range middlewares {
+		getter = m(getter)
+	}
+
+	return &middlewareFlow{
+		getter: getter,
+		flow:   flow,
+	}
+}
+
+type middlewareFlow struct {
+	getter Getter
+	flow   Flow
+}
+
+func (m *middlewareFlow) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	return m.getter.Get(ctx, keys...)
+}
+
+func (m *middlewareFlow) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
+	m.flow.Update(ctx, updateFn)
+}
+
+// UpdateWithPosition calls UpdateWithPosition of the wrapped flow. If the flow
+// does not support positions, the position is always 0.
+func (m *middlewareFlow) UpdateWithPosition(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	if positionFlow, ok := m.flow.(UpdaterWithPosition); ok {
+		positionFlow.UpdateWithPosition(ctx, updateFn)
+		return
+	}
+
+	m.flow.Update(ctx, func(data map[dskey.Key][]byte, err error) {
+		updateFn(0, data, err)
+	})
+}
+
+// UpdateFromPosition calls UpdateFromPosition of the wrapped flow. If the flow
+// is not a Resumer, ErrMissedUpdates is reported and only new updates are
+// sent.
+func (m *middlewareFlow) UpdateFromPosition(ctx context.Context, position uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	resumer, ok := m.flow.(Resumer)
+	if !ok {
+		if position != 0 {
+			updateFn(0, nil, ErrMissedUpdates)
+		}
+		m.UpdateWithPosition(ctx, updateFn)
+		return
+	}
+
+	resumer.UpdateFromPosition(ctx, position, updateFn)
+}
+
+// ResumePosition returns the resume position of the wrapped flow or 0, if it
+// does not implement Resumer.
+func (m *middlewareFlow) ResumePosition() uint64 {
+	resumer, ok := m.flow.(Resumer)
+	if !ok {
+		return 0
+	}
+	return resumer.ResumePosition()
+}
+
+// CoversPosition calls CoversPosition of the wrapped flow.
+func (m *middlewareFlow) CoversPosition(ctx context.Context, position uint64) (bool, error) {
+	resumer, ok := m.flow.(Resumer)
+	if !ok {
+		return false, fmt.Errorf("flow does not support resuming")
+	}
+	return resumer.CoversPosition(ctx, position)
+}
+
+// Backoff calculates the time to wait before a retry. The wait time starts
+// with Initial and is multiplied with Multiplier after each attempt until it
+// reaches Max.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+// DefaultBackoff starts with 100ms and waits at most 5s.
+var DefaultBackoff = Backoff{
+	Initial:    100 * time.Millisecond,
+	Max:        5 * time.Second,
+	Multiplier: 2,
+}
+
+// Delay returns the wait time before the given attempt. The first retry has
+// the attempt 1.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := float64(b.Initial)
+	for i := 1; i < attempt && delay < float64(b.Max); i++ {
+		delay *= b.Multiplier
+	}
+
+	return min(time.Duration(delay), b.Max)
+}
+
+// Wait blocks for the delay of the attempt or until the context is done.
+func (b Backoff) Wait(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(b.Delay(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Retry is a getter middleware, that calls the getter again, if it returns an
+// error.
+type Retry struct {
+	getter   Getter
+	attempts int
+	backoff  Backoff
+}
+
+// NewRetry initializes a Retry. The getter is called at most attempts times.
+func NewRetry(getter Getter, attempts int, backoff Backoff) *Retry {
+	return &Retry{
+		getter:   getter,
+		attempts: max(attempts, 1),
+		backoff:  backoff,
+	}
+}
+
+// Get calls the getter until it succeeds. Errors from an open circuit breaker
+// and a done context are not retried. A DegradedError is returned together
+// with the values without retrying, because the getter answered.
+func (r *Retry) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	var err error
+	for attempt := range r.attempts {
+		if attempt > 0 {
+			if waitErr := r.backoff.Wait(ctx, attempt); waitErr != nil {
+				return nil, fmt.Errorf("waiting for retry after error %v: %w", err, waitErr)
+			}
+		}
+
+		var data map[dskey.Key][]byte
+		data, err = r.getter.Get(ctx, keys...)
+		if err == nil || isDegraded(err) {
+			return data, err
+		}
+
+		if ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("after %d attempts: %w", r.attempts, err)
+}
+
+// isDegraded returns true, if the error is a DegradedError. In this case, the
+// values are returned together with the error.
+func isDegraded(err error) bool {
+	var degraded *DegradedError
+	return errors.As(err, &degraded)
+}
+
+// Timeout is a getter middleware, that cancels requests after a duration.
+type Timeout struct {
+	getter  Getter
+	timeout time.Duration
+}
+
+// NewTimeout initializes a Timeout.
+func NewTimeout(getter Getter, timeout time.Duration) *Timeout {
+	return &Timeout{
+		getter:  getter,
+		timeout: timeout,
+	}
+}
+
+// Get calls the getter with a context, that is canceled after the timeout.
+func (t *Timeout) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	return t.getter.Get(ctx, keys...)
+}
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+// States of a CircuitBreaker.
+const (
+	// CircuitClosed means, that requests are sent to the getter.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen means, that requests fail without calling the getter.
+	CircuitOpen
+
+	// CircuitHalfOpen means, that one request is sent to the getter to test,
+	// if it works again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitBreaker is a getter middleware, that stops calling the getter, after
+// it failed some times in a row. This prevents that many requests wait for a
+// getter that is down.
+//
+// After a cooldown, one request is sent to the getter. If it succeeds, the
+// circuit is closed again.
+type CircuitBreaker struct {
+	getter    Getter
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+}
+
+// NewCircuitBreaker initializes a CircuitBreaker. The circuit opens after
+// threshold failures in a row.
+func NewCircuitBreaker(getter Getter, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		getter:    getter,
+		threshold: max(threshold, 1),
+		cooldown:  cooldown,
+	}
+}
+
+// Get calls the getter, if the circuit is not open. Otherwise it returns
+// ErrCircuitOpen.
+//
+// A DegradedError is not counted as failure, because the getter answered.
+func (c *CircuitBreaker) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+
+	data, err := c.getter.Get(ctx, keys...)
+	c.record(ctx, err)
+	return data, err
+}
+
+// State returns the current state of the circuit.
+func (c *CircuitBreaker) State() CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == CircuitOpen && time.Since(c.openedAt) >= c.cooldown {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+func (c *CircuitBreaker) allow() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < c.cooldown {
+			return ErrCircuitOpen
+		}
+		c.state = CircuitHalfOpen
+		return nil
+
+	case CircuitHalfOpen:
+		// Only one request tests the getter.
+		return ErrCircuitOpen
+
+	default:
+		return nil
+	}
+}
+
+func (c *CircuitBreaker) record(ctx context.Context, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil || isDegraded(err) {
+		c.state = CircuitClosed
+		c.failures = 0
+		return
+	}
+
+	if ctx.Err() != nil {
+		// The caller canceled the request. This is not a failure of the
+		// getter.
+		if c.state == CircuitHalfOpen {
+			c.state = CircuitOpen
+		}
+		return
+	}
+
+	c.failures++
+	if c.state == CircuitHalfOpen || c.failures >= c.threshold {
+		c.state = CircuitOpen
+		c.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,243 @@
+package flow_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+// failingGetter fails the first calls and then returns the values of a stub.
+type failingGetter struct {
+	failures atomic.Int64
+	calls    atomic.Int64
+}
+
+func (g *failingGetter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	g.calls.Add(1)
+	if g.failures.Add(-1) >= 0 {
+		return nil, errors.New("getter failed")
+	}
+	return dsmock.Stub{}.Get(ctx, keys...)
+}
+
+var testBackoff = flow.Backoff{Initial: time.Millisecond, Max: 4 * time.Millisecond, Multiplier: 2}
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt, expect := range map[int]time.Duration{
+		1: time.Millisecond,
+		2: 2 * time.Millisecond,
+		3: 4 * time.Millisecond,
+		4: 4 * time.Millisecond,
+	} {
+		if got := testBackoff.Delay(attempt); got != expect {
+			t.Errorf("Delay(%d) = %s, expected %s", attempt, got, expect)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	key := dskey.MustKey("user/1/username")
+
+	t.Run("succeeds after failures", func(t *testing.T) {
+		getter := &failingGetter{}
+		getter.failures.Store(2)
+
+		if _, err := flow.NewRetry(getter, 3, testBackoff).Get(ctx, key); err != nil {
+			t.Errorf("Get: %v", err)
+		}
+
+		if got := getter.calls.Load(); got != 3 {
+			t.Errorf("getter was called %d times, expected 3", got)
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		getter := &failingGetter{}
+		getter.failures.Store(5)
+
+		if _, err := flow.NewRetry(getter, 3, testBackoff).Get(ctx, key); err == nil {
+			t.Errorf("Get returned no error")
+		}
+
+		if got := getter.calls.Load(); got != 3 {
+			t.Errorf("getter was called %d times, expected 3", got)
+		}
+	})
+
+	t.Run("context done while waiting", func(t *testing.T) {
+		getter := &failingGetter{}
+		getter.failures.Store(5)
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Millisecond)
+		defer cancel()
+
+		slowBackoff := flow.Backoff{Initial: time.Hour, Max: time.Hour, Multiplier: 1}
+		_, err := flow.NewRetry(getter, 3, slowBackoff).Get(ctx, key)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Get returned %v, expected DeadlineExceeded", err)
+		}
+	})
+
+	t.Run("does not retry an open circuit", func(t *testing.T) {
+		getter := &failingGetter{}
+		getter.failures.Store(5)
+		breaker := flow.NewCircuitBreaker(getter, 1, time.Hour)
+
+		_, err := flow.NewRetry(breaker, 3, testBackoff).Get(ctx, key)
+		if !errors.Is(err, flow.ErrCircuitOpen) {
+			t.Errorf("Get returned %v, expected ErrCircuitOpen", err)
+		}
+
+		if got := getter.calls.Load(); got != 1 {
+			t.Errorf("getter was called %d times, expected 1", got)
+		}
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	blocking := flow.NewTimeout(blockingGetter{}, time.Millisecond)
+
+	_, err := blocking.Get(context.Background(), dskey.MustKey("user/1/username"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Get returned %v, expected DeadlineExceeded", err)
+	}
+}
+
+type blockingGetter struct{}
+
+func (blockingGetter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	key := dskey.MustKey("user/1/username")
+
+	getter := &failingGetter{}
+	getter.failures.Store(3)
+	breaker := flow.NewCircuitBreaker(getter, 2, 10*time.Millisecond)
+
+	for range 2 {
+		if _, err := breaker.Get(ctx, key); err == nil || errors.Is(err, flow.ErrCircuitOpen) {
+			t.Fatalf("Get returned %v, expected the error of the getter", err)
+		}
+	}
+
+	if got := breaker.State(); got != flow.CircuitOpen {
+		t.Errorf("State() = %s, expected open", got)
+	}
+
+	if _, err := breaker.Get(ctx, key); !errors.Is(err, flow.ErrCircuitOpen) {
+		t.Errorf("Get returned %v, expected ErrCircuitOpen", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The test request fails, so the circuit opens again.
+	if _, err := breaker.Get(ctx, key); err == nil || errors.Is(err, flow.ErrCircuitOpen) {
+		t.Errorf("Get after cooldown returned %v, expected the error of the getter", err)
+	}
+
+	if got := breaker.State(); got != flow.CircuitOpen {
+		t.Errorf("State() = %s, expected open", got)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := breaker.Get(ctx, key); err != nil {
+		t.Errorf("Get after second cooldown: %v", err)
+	}
+
+	if got := breaker.State(); got != flow.CircuitClosed {
+		t.Errorf("State() = %s, expected closed", got)
+	}
+
+	if got := getter.calls.Load(); got != 4 {
+		t.Errorf("getter was called %d times, expected 4", got)
+	}
+}
+
+func TestDegradedIsNoFailure(t *testing.T) {
+	ctx := context.Background()
+	key := dskey.MustKey("user/1/username")
+	voteKey := dskey.MustKey("poll/1/live_votes")
+
+	counter := dsmock.NewCounter(degradedGetter{
+		Getter: dsmock.Stub(dsmock.YAMLData(`user/1/username: hugo`)),
+		key:    voteKey,
+	})
+	breaker := flow.NewCircuitBreaker(counter, 1, time.Hour)
+	retry := flow.NewRetry(breaker, 3, testBackoff)
+
+	for range 2 {
+		got, err := retry.Get(ctx, key, voteKey)
+
+		var degraded *flow.DegradedError
+		if !errors.As(err, &degraded) {
+			t.Fatalf("Get returned %v, expected a DegradedError", err)
+		}
+
+		if string(got[key]) != `"hugo"` {
+			t.Errorf("got %v, expected the values with the error", got)
+		}
+	}
+
+	if got := len(counter.Requests()); got != 2 {
+		t.Errorf("getter was called %d times, expected 2", got)
+	}
+
+	if got := breaker.State(); got != flow.CircuitClosed {
+		t.Errorf("State() = %s, expected closed", got)
+	}
+}
+
+func TestWithMiddlewares(t *testing.T) {
+	ds := dsmock.NewFlow(dsmock.YAMLData(`user/1/username: hugo`))
+
+	f := flow.WithMiddlewares(ds, func(g flow.Getter) flow.Getter {
+		return flow.NewTimeout(g, time.Second)
+	})
+
+	key := dskey.MustKey("user/1/username")
+	got, err := f.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if string(got[key]) != `"hugo"` {
+		t.Errorf("got %s, expected hugo", got[key])
+	}
+}
+
+func TestWithMiddlewaresResumes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := &positionFlow{Flow: dsmock.NewFlow(dsmock.Stub{}), resumedFrom: make(chan uint64, 1)}
+	f := flow.WithMiddlewares(ds, func(g flow.Getter) flow.Getter {
+		return flow.NewTimeout(g, time.Second)
+	})
+
+	resumer, ok := f.(flow.Resumer)
+	if !ok {
+		t.Fatalf("flow with middlewares is not a Resumer")
+	}
+
+	if got := resumer.ResumePosition(); got != 42 {
+		t.Errorf("ResumePosition() = %d, expected 42", got)
+	}
+
+	go resumer.UpdateFromPosition(ctx, 21, func(uint64, map[dskey.Key][]byte, error) {})
+
+	if got := <-ds.resumedFrom; got != 21 {
+		t.Errorf("flow was resumed from %d, expected 21", got)
+	}
+}
@@ -0,0 +1,132 @@
+package flow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsrecorder"
+)
+
+// Watch calls keysFn to find the keys it depends on and calls fn with the
+// values of these keys. Afterwards, it calls fn with the keys, that changed.
+//
+// keysFn gets a Getter that records all requested keys. Each time one of the
+// recorded keys changes, keysFn is called again. So the watched keys can
+// change. Keys, that are new, are sent to fn with their value. Keys, that are
+// not watched anymore, are sent to fn with the value nil.
+//
+// The first call to fn contains all keys. Later calls only contain the changed
+// keys.
+//
+// Watch blocks until the context is done, the hub has stopped or an error
+// happens. Errors from keysFn or fn and ErrHubStopped are returned. If the
+// flow of the hub reports an error, like ErrMissedUpdates or a reconnect of
+// the listener, changes could be missed. So all keys are compared again.
+func Watch(
+	ctx context.Context,
+	hub *Hub,
+	keysFn func(ctx context.Context, getter Getter) error,
+	fn func(map[dskey.Key][]byte) error,
+) error {
+	sub := hub.Subscribe(ctx)
+	defer sub.Close()
+
+	known := make(map[dskey.Key][]byte)
+	first := true
+	for {
+		seen := &valueRecorder{getter: hub, values: make(map[dskey.Key][]byte)}
+		recorder := dsrecorder.New(seen)
+		if err := keysFn(ctx, recorder); err != nil {
+			return fmt.Errorf("calling keys function: %w", err)
+		}
+
+		keys := make([]dskey.Key, 0, len(recorder.Keys()))
+		for key := range recorder.Keys() {
+			keys = append(keys, key)
+		}
+
+		// The keys are subscribed after keysFn has run. A change, that happens
+		// before, is not sent to the subscription. So the values are fetched
+		// again after subscribing. If they are not the values, that keysFn
+		// has seen, keysFn is called again.
+		sub.SetKeys(keys...)
+		current, err := hub.Get(ctx, keys...)
+		if err != nil {
+			return fmt.Errorf("fetching watched keys: %w", err)
+		}
+
+		if seen.changed || len(diffValues(seen.values, current)) > 0 {
+			continue
+		}
+
+		changed := diffValues(known, current)
+		known = current
+
+		if first || len(changed) > 0 {
+			if err := fn(changed); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		if _, err := sub.Next(ctx); err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrUnsubscribed) {
+				return nil
+			}
+
+			if errors.Is(err, ErrHubStopped) {
+				return fmt.Errorf("waiting for changes: %w", err)
+			}
+
+			// Other errors come from the flow, that keeps running. The
+			// values are compared again in the next iteration.
+		}
+	}
+}
+
+// valueRecorder is a getter, that remembers the returned values.
+type valueRecorder struct {
+	getter Getter
+	values map[dskey.Key][]byte
+
+	// changed is true, if a key was returned with different values.
+	changed bool
+}
+
+func (r *valueRecorder) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	data, err := r.getter.Get(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range data {
+		if old, ok := r.values[key]; ok && !bytes.Equal(old, value) {
+			r.changed = true
+		}
+		r.values[key] = value
+	}
+	return data, nil
+}
+
+// diffValues returns the keys of current, that are new or have an other value
+// then in old. Keys, that are only in old, are returned with the value nil.
+func diffValues(old, current map[dskey.Key][]byte) map[dskey.Key][]byte {
+	changed := make(map[dskey.Key][]byte)
+	for key, value := range current {
+		oldValue, ok := old[key]
+		if !ok || !bytes.Equal(oldValue, value) {
+			changed[key] = value
+		}
+	}
+
+	for key := range old {
+		if _, ok := current[key]; !ok {
+			changed[key] = nil
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,183 @@
+package flow_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/dsmock"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	usernameKey := dskey.MustKey("user/1/username")
+	firstNameKey := dskey.MustKey("user/1/first_name")
+	motionKey := dskey.MustKey("motion/1/title")
+
+	ds := dsmock.NewFlow(dsmock.YAMLData(`---
+	user/1/username: hugo
+	user/1/first_name: Hugo
+	motion/1/title: title
+	`))
+	hub := flow.NewHub(ds)
+	go hub.Run(ctx)
+
+	// The first name is only watched, if the username is hugo.
+	keysFn := func(ctx context.Context, getter flow.Getter) error {
+		data, err := getter.Get(ctx, usernameKey)
+		if err != nil {
+			return err
+		}
+
+		if string(data[usernameKey]) == `"hugo"` {
+			_, err = getter.Get(ctx, firstNameKey)
+		}
+		return err
+	}
+
+	received := make(chan map[dskey.Key][]byte)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- flow.Watch(ctx, hub, keysFn, func(data map[dskey.Key][]byte) error {
+			received <- data
+			return nil
+		})
+	}()
+
+	expect := map[dskey.Key][]byte{
+		usernameKey:  []byte(`"hugo"`),
+		firstNameKey: []byte(`"Hugo"`),
+	}
+	if got := <-received; !reflect.DeepEqual(got, expect) {
+		t.Errorf("first call got %v, expected %v", got, expect)
+	}
+
+	// Changes of other keys are ignored.
+	ds.Send(map[dskey.Key][]byte{motionKey: []byte(`"new title"`)})
+
+	ds.Send(map[dskey.Key][]byte{usernameKey: []byte(`"max"`)})
+
+	expect = map[dskey.Key][]byte{
+		usernameKey:  []byte(`"max"`),
+		firstNameKey: nil,
+	}
+	if got := <-received; !reflect.DeepEqual(got, expect) {
+		t.Errorf("after change got %v, expected %v", got, expect)
+	}
+
+	cancel()
+	if err := <-watchErr; err != nil {
+		t.Errorf("Watch returned: %v", err)
+	}
+}
+
+func TestWatchChangeWhileKeysFnRuns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	usernameKey := dskey.MustKey("user/1/username")
+	firstNameKey := dskey.MustKey("user/1/first_name")
+
+	ds := dsmock.NewFlow(dsmock.YAMLData(`---
+	user/1/username: hugo
+	user/1/first_name: Hugo
+	`))
+	hub := flow.NewHub(ds)
+	go hub.Run(ctx)
+
+	calls := 0
+	keysFn := func(ctx context.Context, getter flow.Getter) error {
+		calls++
+		data, err := getter.Get(ctx, usernameKey)
+		if err != nil {
+			return err
+		}
+
+		if calls == 1 {
+			// The username changes, before the keys are subscribed.
+			ds.Send(map[dskey.Key][]byte{usernameKey: []byte(`"max"`)})
+		}
+
+		if string(data[usernameKey]) == `"hugo"` {
+			_, err = getter.Get(ctx, firstNameKey)
+		}
+		return err
+	}
+
+	received := make(chan map[dskey.Key][]byte, 1)
+	go flow.Watch(ctx, hub, keysFn, func(data map[dskey.Key][]byte) error {
+		received <- data
+		return nil
+	})
+
+	expect := map[dskey.Key][]byte{
+		usernameKey: []byte(`"max"`),
+	}
+	if got := <-received; !reflect.DeepEqual(got, expect) {
+		t.Errorf("first call got %v, expected %v", got, expect)
+	}
+}
+
+// reconnectFlow is a flow, that can report errors and keeps running.
+type reconnectFlow struct {
+	*dsmock.Flow
+	errs chan error
+}
+
+func (f reconnectFlow) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
+	go func() {
+		for {
+			select {
+			case err := <-f.errs:
+				updateFn(nil, err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	f.Flow.Update(ctx, updateFn)
+}
+
+func TestWatchContinuesAfterFlowError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	key := dskey.MustKey("user/1/username")
+	ds := reconnectFlow{Flow: dsmock.NewFlow(dsmock.YAMLData(`user/1/username: hugo`)), errs: make(chan error)}
+	hub := flow.NewHub(ds)
+	go hub.Run(ctx)
+
+	keysFn := func(ctx context.Context, getter flow.Getter) error {
+		_, err := getter.Get(ctx, key)
+		return err
+	}
+
+	received := make(chan map[dskey.Key][]byte, 1)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- flow.Watch(ctx, hub, keysFn, func(data map[dskey.Key][]byte) error {
+			received <- data
+			return nil
+		})
+	}()
+
+	<-received
+
+	ds.errs <- errors.New("listener reconnected")
+	ds.Send(map[dskey.Key][]byte{key: []byte(`"max"`)})
+
+	select {
+	case got := <-received:
+		if string(got[key]) != `"max"` {
+			t.Errorf("got %v, expected the new username", got)
+		}
+	case err := <-watchErr:
+		t.Fatalf("Watch returned after a flow error: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+)
+
+// EventType is the kind of a write Event.
+type EventType int
+
+// Types of write events.
+const (
+	// EventCreate creates a new object.
+	EventCreate EventType = iota + 1
+
+	// EventUpdate changes fields of an existing object.
+	EventUpdate
+
+	// EventDelete deletes an existing object.
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCreate:
+		return "create"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is one change of a write.
+type Event struct {
+	Type EventType
+
+	// FQID is the object in the form collection/id.
+	FQID string
+
+	// Fields are the values of a create or update event. The values are
+	// encoded as json like the values returned by a Getter. The value nil
+	// removes the value of a field.
+	Fields map[string]json.RawMessage
+}
+
+// CollectionID returns the collection and the id of the FQID of the event.
+func (e Event) CollectionID() (string, int, error) {
+	collection, rawID, ok := strings.Cut(e.FQID, "/")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid fqid %s", e.FQID)
+	}
+
+	id, err := strconv.Atoi(rawID)
+	if err != nil || id <= 0 {
+		return "", 0, fmt.Errorf("invalid id in fqid %s", e.FQID)
+	}
+
+	if !dskey.ValidateCollectionField(collection, "id") {
+		return "", 0, fmt.Errorf("unknown collection in fqid %s", e.FQID)
+	}
+
+	return collection, id, nil
+}
+
+// Writer writes events to the datastore.
+type Writer interface {
+	// Write applies all events in one transaction. Either all events are
+	// written or none.
+	//
+	// It returns the position of the write. It can be used with a getter,
+	// that supports positions, to read the written values.
+	Write(ctx context.Context, events ...Event) (uint64, error)
+
+	// ReserveIDs returns count new ids of the collection. A create event has
+	// to use a reserved id.
+	ReserveIDs(ctx context.Context, collection string, count int) ([]int, error)
+}
@@ -0,0 +1,24 @@
+package flow_test
+
+import (
+	"testing"
+
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+)
+
+func TestEventCollectionID(t *testing.T) {
+	collection, id, err := flow.Event{FQID: "motion/5"}.CollectionID()
+	if err != nil {
+		t.Fatalf("CollectionID: %v", err)
+	}
+
+	if collection != "motion" || id != 5 {
+		t.Errorf("got %s and %d, expected motion and 5", collection, id)
+	}
+
+	for _, fqid := range []string{"motion", "motion/0", "motion/abc", "motoin/5", "motion/5/title"} {
+		if _, _, err := (flow.Event{FQID: fqid}).CollectionID(); err == nil {
+			t.Errorf("CollectionID of %s returned no error", fqid)
+		}
+	}
+}
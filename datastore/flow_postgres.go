@@ -5,13 +5,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"net"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
 	"github.com/OpenSlides/openslides-go/environment"
+	"github.com/OpenSlides/openslides-go/oslog"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
 	"github.com/jackc/pgx/v5/pgxpool"
@@ -20,17 +26,86 @@ import (
 //go:generate  sh -c "go run genfields/main.go > field_def.go"
 
 var (
-	envPostgresHost         = environment.NewVariable("DATABASE_HOST", "localhost", "Postgres Host.")
-	envPostgresPort         = environment.NewVariable("DATABASE_PORT", "5432", "Postgres Post.")
-	envPostgresDatabase     = environment.NewVariable("DATABASE_NAME", "openslides", "Postgres User.")
-	envPostgresUser         = environment.NewVariable("DATABASE_USER", "openslides", "Postgres Database.")
-	envPostgresPasswordFile = environment.NewVariable("DATABASE_PASSWORD_FILE", "/run/secrets/postgres_password", "Postgres Password.")
+	envPostgresHost          = environment.NewVariable("DATABASE_HOST", "localhost", "Postgres Host.")
+	envPostgresPort          = environment.NewVariable("DATABASE_PORT", "5432", "Postgres Post.")
+	envPostgresDatabase      = environment.NewVariable("DATABASE_NAME", "openslides", "Postgres User.")
+	envPostgresUser          = environment.NewVariable("DATABASE_USER", "openslides", "Postgres Database.")
+	envPostgresPasswordFile  = environment.NewVariable("DATABASE_PASSWORD_FILE", "/run/secrets/postgres_password", "Postgres Password.")
+	envPostgresSnapshotRead  = environment.NewVariable("DATABASE_SNAPSHOT_READ", "false", "Read all collections of one request in one REPEATABLE READ transaction.")
+	envPostgresQueryMode     = environment.NewVariable("DATABASE_QUERY_MODE", "simple", "Protocol to query postgres. `simple` sends the sql text with each request. `prepared` uses cached prepared statements and binary values.")
+	envPostgresNotifyLatency = environment.NewVariable("DATABASE_NOTIFY_MAX_LATENCY", "0", "Time to collect database notifications before they are processed together. 0 processes each notification on its own. A value like 20ms reduces the load with many writes, but delays each update.")
+
+	envPostgresMaxConns          = environment.NewVariable("DATABASE_MAX_CONNS", "0", "Maximum number of connections in the pool. 0 uses the greater value of 4 and the number of CPUs.")
+	envPostgresMinConns          = environment.NewVariable("DATABASE_MIN_CONNS", "0", "Minimum number of idle connections in the pool.")
+	envPostgresMaxConnLifetime   = environment.NewVariable("DATABASE_MAX_CONN_LIFETIME", "1h", "Duration after which a connection is closed.")
+	envPostgresMaxConnIdleTime   = environment.NewVariable("DATABASE_MAX_CONN_IDLE_TIME", "30m", "Duration after which an idle connection is closed.")
+	envPostgresHealthCheckPeriod = environment.NewVariable("DATABASE_HEALTH_CHECK_PERIOD", "1m", "Duration between checks of the idle connections.")
+	envPostgresStatementTimeout  = environment.NewVariable("DATABASE_STATEMENT_TIMEOUT", "0", "Maximum duration of a statement. 0 disables the timeout.")
+
+	envPostgresSSLMode     = environment.NewVariable("DATABASE_SSL_MODE", "prefer", "Postgres sslmode. One of disable, allow, prefer, require, verify-ca or verify-full.")
+	envPostgresSSLRootCert = environment.NewVariable("DATABASE_SSL_ROOT_CERT_FILE", "", "File with the certificate authorities to verify the server certificate.")
+	envPostgresSSLCert     = environment.NewVariable("DATABASE_SSL_CERT_FILE", "", "File with the client certificate.")
+	envPostgresSSLKey      = environment.NewVariable("DATABASE_SSL_KEY_FILE", "", "File with the key of the client certificate.")
+
+	envPostgresReplicaHosts = environment.NewVariable("DATABASE_REPLICA_HOSTS", "", "Comma separated list of read replicas as host or host:port. Get requests are sent to the replicas. All other settings are the same as for the primary.")
 )
 
 // FlowPostgres uses postgres to get the connections.
+//
+// If the table os_notify_log_t has a column `data`, it is used to send updates
+// without reading the changed rows again. The column has to contain a json
+// object from the field names of the row to the postgres text representation
+// of the values. If the column is NULL, the values are read from the database.
+//
+// If DATABASE_REPLICA_HOSTS is set, Get reads from the replicas. A replica is
+// only used, if it contains the last transaction, that was seen by Update.
+// Otherwise, the values are read from the primary.
 type FlowPostgres struct {
-	Pool  *pgxpool.Pool
-	enums map[uint32]struct{}
+	Pool       *pgxpool.Pool
+	replicas   []*pgxpool.Pool
+	enums      map[uint32]struct{}
+	enumArrays map[uint32]uint32
+
+	// fieldTypes is a map from collection/field to the type oid of the column.
+	// It is only set, when the notify log contains the values of the rows.
+	fieldTypes map[string]uint32
+
+	snapshotRead     bool
+	notifyMaxLatency time.Duration
+
+	nextReplica atomic.Uint64
+	lastXactID  atomic.Uint64
+
+	// resumePosition is the lowest transaction id, that is maybe not sent to
+	// the updateFn yet.
+	resumePosition atomic.Uint64
+
+	// columns are the writable columns of each table. They are read by the
+	// first write to the table.
+	columnsMu sync.Mutex
+	columns   map[string]map[string]writeColumn
+
+	// reserved are the ids by collection, that were returned by ReserveIDs
+	// and were not used by a write yet.
+	reservedMu sync.Mutex
+	reserved   map[string]map[int]struct{}
+}
+
+// raiseLastXactID sets lastXactID to the given id, if it is higher. A
+// transaction with a lower id can commit after a higher one. lastXactID must
+// not be lowered in this case.
+func (p *FlowPostgres) raiseLastXactID(id uint64) {
+	for {
+		last := p.lastXactID.Load()
+		if id <= last || p.lastXactID.CompareAndSwap(last, id) {
+			return
+		}
+	}
+}
+
+// querier is implemented by *pgx.Conn and pgx.Tx.
+type querier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
 }
 
 // encodePostgresConfig encodes a string to be used in the postgres key value style.
@@ -42,27 +117,50 @@ func encodePostgresConfig(s string) string {
 	return s
 }
 
-func postgresDSN(lookup environment.Environmenter) (string, error) {
+func postgresDSN(lookup environment.Environmenter, host, port string) (string, error) {
 	password, err := environment.ReadSecret(lookup, envPostgresPasswordFile)
 	if err != nil {
 		return "", fmt.Errorf("reading postgres password: %w", err)
 	}
 
-	return fmt.Sprintf(
-		`user='%s' password='%s' host='%s' port='%s' dbname='%s'`,
+	statementTimeout, err := environment.ParseDuration(envPostgresStatementTimeout.Value(lookup))
+	if err != nil {
+		return "", fmt.Errorf("parsing %s: %w", envPostgresStatementTimeout.Key, err)
+	}
+
+	dsn := fmt.Sprintf(
+		`user='%s' password='%s' host='%s' port='%s' dbname='%s' sslmode='%s' statement_timeout='%d'`,
 		encodePostgresConfig(envPostgresUser.Value(lookup)),
 		encodePostgresConfig(password),
-		encodePostgresConfig(envPostgresHost.Value(lookup)),
-		encodePostgresConfig(envPostgresPort.Value(lookup)),
+		encodePostgresConfig(host),
+		encodePostgresConfig(port),
 		encodePostgresConfig(envPostgresDatabase.Value(lookup)),
-	), nil
+		encodePostgresConfig(envPostgresSSLMode.Value(lookup)),
+		statementTimeout.Milliseconds(),
+	)
+
+	for _, file := range []struct {
+		key string
+		env environment.Variable
+	}{
+		{"sslrootcert", envPostgresSSLRootCert},
+		{"sslcert", envPostgresSSLCert},
+		{"sslkey", envPostgresSSLKey},
+	} {
+		if path := file.env.Value(lookup); path != "" {
+			dsn += fmt.Sprintf(` %s='%s'`, file.key, encodePostgresConfig(path))
+		}
+	}
+
+	return dsn, nil
 }
 
-// NewFlowPostgres initializes a SourcePostgres.
-func NewFlowPostgres(lookup environment.Environmenter) (*FlowPostgres, error) {
-	addr, err := postgresDSN(lookup)
+// postgresPoolConfig creates the config for a connection pool to the given
+// host.
+func postgresPoolConfig(lookup environment.Environmenter, host, port string) (*pgxpool.Config, error) {
+	addr, err := postgresDSN(lookup, host, port)
 	if err != nil {
-		return nil, fmt.Errorf("reading postgres password: %w", err)
+		return nil, fmt.Errorf("creating dsn: %w", err)
 	}
 
 	config, err := pgxpool.ParseConfig(addr)
@@ -70,7 +168,109 @@ func NewFlowPostgres(lookup environment.Environmenter) (*FlowPostgres, error) {
 		return nil, fmt.Errorf("parse config: %w", err)
 	}
 
-	config.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	switch mode := envPostgresQueryMode.Value(lookup); mode {
+	case "simple":
+		config.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	case "prepared":
+		config.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeCacheStatement
+	default:
+		return nil, fmt.Errorf("invalid value for %s: %s", envPostgresQueryMode.Key, mode)
+	}
+
+	for _, conns := range []struct {
+		env    environment.Variable
+		target *int32
+	}{
+		{envPostgresMaxConns, &config.MaxConns},
+		{envPostgresMinConns, &config.MinConns},
+	} {
+		value, err := strconv.ParseInt(conns.env.Value(lookup), 10, 32)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid value for %s: %s", conns.env.Key, conns.env.Value(lookup))
+		}
+
+		if value > 0 {
+			*conns.target = int32(value)
+		}
+	}
+
+	if config.MinConns > config.MaxConns {
+		return nil, fmt.Errorf("%s has to be smaller or equal to %s", envPostgresMinConns.Key, envPostgresMaxConns.Key)
+	}
+
+	for _, duration := range []struct {
+		env    environment.Variable
+		target *time.Duration
+	}{
+		{envPostgresMaxConnLifetime, &config.MaxConnLifetime},
+		{envPostgresMaxConnIdleTime, &config.MaxConnIdleTime},
+		{envPostgresHealthCheckPeriod, &config.HealthCheckPeriod},
+	} {
+		value, err := environment.ParseDuration(duration.env.Value(lookup))
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", duration.env.Key, err)
+		}
+		*duration.target = value
+	}
+
+	return config, nil
+}
+
+// postgresHost is the address of a postgres server.
+type postgresHost struct {
+	host string
+	port string
+}
+
+// parseReplicaHosts parses the value of DATABASE_REPLICA_HOSTS. Each entry
+// is a host or host:port. Entries without a port use defaultPort.
+func parseReplicaHosts(value string, defaultPort string) ([]postgresHost, error) {
+	var hosts []postgresHost
+	for entry := range strings.SplitSeq(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, ":") {
+			hosts = append(hosts, postgresHost{host: entry, port: defaultPort})
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid replica host %s: %w", entry, err)
+		}
+
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("invalid replica host %s", entry)
+		}
+
+		hosts = append(hosts, postgresHost{host: host, port: port})
+	}
+	return hosts, nil
+}
+
+// NewFlowPostgres initializes a SourcePostgres.
+func NewFlowPostgres(lookup environment.Environmenter) (*FlowPostgres, error) {
+	port := envPostgresPort.Value(lookup)
+	config, err := postgresPoolConfig(lookup, envPostgresHost.Value(lookup), port)
+	if err != nil {
+		return nil, err
+	}
+
+	replicaHosts, err := parseReplicaHosts(envPostgresReplicaHosts.Value(lookup), port)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", envPostgresReplicaHosts.Key, err)
+	}
+
+	replicaConfigs := make([]*pgxpool.Config, len(replicaHosts))
+	for i, host := range replicaHosts {
+		replicaConfigs[i], err = postgresPoolConfig(lookup, host.host, host.port)
+		if err != nil {
+			return nil, fmt.Errorf("config for replica %s: %w", host.host, err)
+		}
+	}
 
 	ctx := context.Background()
 	pool, err := pgxpool.NewWithConfig(ctx, config)
@@ -78,11 +278,35 @@ func NewFlowPostgres(lookup environment.Environmenter) (*FlowPostgres, error) {
 		return nil, fmt.Errorf("creating connection pool: %w", err)
 	}
 
-	flow := FlowPostgres{Pool: pool}
+	replicas := make([]*pgxpool.Pool, len(replicaConfigs))
+	for i, replicaConfig := range replicaConfigs {
+		replicas[i], err = pgxpool.NewWithConfig(ctx, replicaConfig)
+		if err != nil {
+			return nil, fmt.Errorf("creating connection pool for replica %s: %w", replicaHosts[i].host, err)
+		}
+	}
+
+	snapshotRead, _ := strconv.ParseBool(envPostgresSnapshotRead.Value(lookup))
+
+	notifyMaxLatency, err := environment.ParseDuration(envPostgresNotifyLatency.Value(lookup))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", envPostgresNotifyLatency.Key, err)
+	}
+
+	flow := FlowPostgres{
+		Pool:             pool,
+		replicas:         replicas,
+		snapshotRead:     snapshotRead,
+		notifyMaxLatency: notifyMaxLatency,
+	}
 	if err := flow.updateEnums(ctx); err != nil {
 		return nil, err
 	}
 
+	if err := flow.updateFieldTypes(ctx); err != nil {
+		return nil, fmt.Errorf("reading field types: %w", err)
+	}
+
 	return &flow, nil
 }
 
@@ -93,7 +317,7 @@ func (p *FlowPostgres) updateEnums(ctx context.Context) error {
 	}
 	defer c.Release()
 
-	sql := `SELECT oid FROM pg_type WHERE typtype = 'e';`
+	sql := `SELECT oid, typarray FROM pg_type WHERE typtype = 'e';`
 	rows, err := c.Conn().Query(ctx, sql)
 	if err != nil {
 		return err
@@ -101,25 +325,102 @@ func (p *FlowPostgres) updateEnums(ctx context.Context) error {
 	defer rows.Close()
 
 	p.enums = map[uint32]struct{}{}
+	p.enumArrays = map[uint32]uint32{}
 	for rows.Next() {
-		var oid uint32
-		if err := rows.Scan(&oid); err != nil {
+		var oid, arrayOID uint32
+		if err := rows.Scan(&oid, &arrayOID); err != nil {
 			return err
 		}
 
 		p.enums[oid] = struct{}{}
+		p.enumArrays[arrayOID] = oid
 	}
 
 	return nil
 }
 
-// Close closes the connection pool.
+// updateFieldTypes reads the types of all table columns, if the notify log
+// contains the data of the rows.
+func (p *FlowPostgres) updateFieldTypes(ctx context.Context) error {
+	c, err := p.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Release()
+
+	var hasData bool
+	sql := `SELECT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'os_notify_log_t' AND column_name = 'data'
+	);`
+	if err := c.QueryRow(ctx, sql).Scan(&hasData); err != nil {
+		return err
+	}
+
+	if !hasData {
+		return nil
+	}
+
+	sql = `SELECT c.relname, a.attname, a.atttypid
+	FROM pg_attribute a JOIN pg_class c ON c.oid = a.attrelid
+	WHERE c.relkind = 'r' AND c.relnamespace = current_schema()::regnamespace AND a.attnum > 0 AND NOT a.attisdropped;`
+	rows, err := c.Query(ctx, sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	p.fieldTypes = make(map[string]uint32)
+	for rows.Next() {
+		var table, field string
+		var oid uint32
+		if err := rows.Scan(&table, &field, &oid); err != nil {
+			return err
+		}
+
+		p.fieldTypes[strings.TrimSuffix(table, "_t")+"/"+field] = oid
+	}
+
+	return rows.Err()
+}
+
+// Close closes the connection pools.
 func (p *FlowPostgres) Close() {
 	p.Pool.Close()
+	for _, replica := range p.replicas {
+		replica.Close()
+	}
 }
 
 // Get fetches the keys from postgres.
+//
+// If DATABASE_SNAPSHOT_READ is set, Get works like GetSnapshot.
+//
+// If there are replicas, Get uses one of them in a snapshot transaction. If
+// the replica does not contain the last transaction from Update yet or is not
+// available, the values are read from the primary.
 func (p *FlowPostgres) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	if len(p.replicas) > 0 {
+		replica := p.replicas[p.nextReplica.Add(1)%uint64(len(p.replicas))]
+		values, _, visible, err := p.getSnapshot(ctx, replica, p.lastXactID.Load(), keys)
+		if err == nil && visible {
+			return values, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if err != nil {
+			oslog.Warn("Reading from replica, using primary: %v", err)
+		}
+	}
+
+	if p.snapshotRead {
+		values, _, err := p.GetSnapshot(ctx, keys...)
+		return values, err
+	}
+
 	conn, err := p.Pool.Acquire(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("acquiring connection: %w", err)
@@ -129,7 +430,94 @@ func (p *FlowPostgres) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Ke
 	return p.getWithConn(ctx, conn.Conn(), keys...)
 }
 
-func (p *FlowPostgres) getWithConn(ctx context.Context, conn *pgx.Conn, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+// GetSnapshot fetches the keys from postgres inside one read-only REPEATABLE
+// READ transaction. All values are read from the same database state, even
+// when they belong to different collections.
+//
+// It also returns the position of the snapshot. Like the positions of
+// UpdateWithPosition, it is a transaction id, that is visible in the returned
+// values. All transactions with a lower id are visible as well. So it can be
+// used with GetAtPosition.
+func (p *FlowPostgres) GetSnapshot(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, uint64, error) {
+	values, position, _, err := p.getSnapshot(ctx, p.Pool, 0, keys)
+	return values, position, err
+}
+
+// GetAtPosition is like GetSnapshot, but makes sure, that the transaction with
+// the given position is visible in the returned values.
+//
+// The position is usually a value from UpdateWithPosition, GetSnapshot or the
+// transaction id of a write. If the transaction is not committed yet, GetAtPosition waits
+// until it is visible or the context is done.
+func (p *FlowPostgres) GetAtPosition(ctx context.Context, position uint64, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	const retryInterval = 50 * time.Millisecond
+
+	for {
+		values, _, visible, err := p.getSnapshot(ctx, p.Pool, position, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		if visible {
+			return values, nil
+		}
+
+		select {
+		case <-time.After(retryInterval):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting for position %d: %w", position, ctx.Err())
+		}
+	}
+}
+
+// getSnapshot reads the keys in one REPEATABLE READ transaction from the given
+// pool.
+//
+// If minPosition is not 0, it only reads the values, if the transaction
+// minPosition is visible in the snapshot. Otherwise, the returned bool is false.
+func (p *FlowPostgres) getSnapshot(ctx context.Context, pool *pgxpool.Pool, minPosition uint64, keys []dskey.Key) (map[dskey.Key][]byte, uint64, bool, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("acquiring connection: %w", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("begin transaction: %w", err)
+	}
+	// The transaction is read only. There is nothing to commit.
+	defer tx.Rollback(ctx)
+
+	// The snapshot of a REPEATABLE READ transaction is taken with the first
+	// query. So the position has to be read before the data.
+	sql := `SELECT pg_snapshot_xmin(pg_current_snapshot()), $1::xid8 = '0' OR pg_visible_in_snapshot($1::xid8, pg_current_snapshot());`
+	var xmin uint64
+	var visible bool
+	if err := tx.QueryRow(ctx, sql, minPosition).Scan(&xmin, &visible); err != nil {
+		return nil, 0, false, fmt.Errorf("reading snapshot position: %w", err)
+	}
+
+	// xmin is the lowest transaction, that is not finished. So the
+	// transaction before is the highest, that is visible for sure.
+	position := max(xmin, 1) - 1
+
+	if !visible {
+		return nil, position, false, nil
+	}
+
+	values, err := p.getWithConn(ctx, tx, keys...)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return values, position, true, nil
+}
+
+func (p *FlowPostgres) getWithConn(ctx context.Context, conn querier, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
 	collectionIDs := make(map[string][]int)
 	collectionFields := make(map[string][]string)
 
@@ -157,17 +545,9 @@ func (p *FlowPostgres) getWithConn(ctx context.Context, conn *pgx.Conn, keys ...
 		fields := []string{"id"}
 		fields = append(fields, collectionFields[collection]...)
 
-		// TODO: Remove me, if the new vote service and projector service are merged
-		switch collection {
-		case "poll":
-			fields = slices.DeleteFunc(fields, func(s string) bool {
-				return s == "live_votes"
-			})
-		case "projection":
-			fields = slices.DeleteFunc(fields, func(s string) bool {
-				return s == "content"
-			})
-		}
+		fields = slices.DeleteFunc(fields, func(field string) bool {
+			return IsComputedField(collection + "/" + field)
+		})
 
 		sql := fmt.Sprintf(
 			`SELECT %s FROM "%s" WHERE id = ANY ($1) `,
@@ -193,9 +573,14 @@ func (p *FlowPostgres) getWithConn(ctx context.Context, conn *pgx.Conn, keys ...
 			err = forEachRow(rows, func(row pgx.CollectableRow) error {
 				values := row.RawValues()
 
-				id, err := strconv.Atoi(string(values[0]))
+				rawID, err := p.convertField(values[0], fieldDescription[0])
 				if err != nil {
-					return fmt.Errorf("invalid id %s: %w", string(values[0]), err)
+					return fmt.Errorf("convert id: %w", err)
+				}
+
+				id, err := strconv.Atoi(string(rawID))
+				if err != nil {
+					return fmt.Errorf("invalid id %s: %w", rawID, err)
 				}
 
 				idKey, err := dskey.FromParts(collection, id, "id")
@@ -216,7 +601,7 @@ func (p *FlowPostgres) getWithConn(ctx context.Context, conn *pgx.Conn, keys ...
 						continue
 					}
 
-					keyValues[key], err = p.convertValue(value, fieldDescription[i].DataTypeOID)
+					keyValues[key], err = p.convertField(value, fieldDescription[i])
 					if err != nil {
 						return fmt.Errorf("convert value for field %s/%s: %w", collection, field, err)
 					}
@@ -240,20 +625,42 @@ func (p *FlowPostgres) getWithConn(ctx context.Context, conn *pgx.Conn, keys ...
 	return result, nil
 }
 
+// arrayElementOIDs maps the supported array types to the type of there
+// elements.
+var arrayElementOIDs = map[uint32]uint32{
+	pgtype.Int2ArrayOID:        pgtype.Int2OID,
+	pgtype.Int4ArrayOID:        pgtype.Int4OID,
+	pgtype.Int8ArrayOID:        pgtype.Int8OID,
+	pgtype.Float4ArrayOID:      pgtype.Float4OID,
+	pgtype.Float8ArrayOID:      pgtype.Float8OID,
+	pgtype.NumericArrayOID:     pgtype.NumericOID,
+	pgtype.BoolArrayOID:        pgtype.BoolOID,
+	pgtype.TextArrayOID:        pgtype.TextOID,
+	pgtype.VarcharArrayOID:     pgtype.VarcharOID,
+	pgtype.BPCharArrayOID:      pgtype.BPCharOID,
+	pgtype.JSONArrayOID:        pgtype.JSONOID,
+	pgtype.JSONBArrayOID:       pgtype.JSONBOID,
+	pgtype.DateArrayOID:        pgtype.DateOID,
+	pgtype.TimestampArrayOID:   pgtype.TimestampOID,
+	pgtype.TimestamptzArrayOID: pgtype.TimestamptzOID,
+}
+
+// convertValue converts a value in the text format of postgres to json.
 func (p *FlowPostgres) convertValue(value []byte, oid uint32) ([]byte, error) {
 	switch oid {
-	case pgtype.VarcharOID, pgtype.TextOID:
+	case pgtype.VarcharOID, pgtype.TextOID, pgtype.BPCharOID:
 		return json.Marshal(string(value))
 
-	case pgtype.Int4OID, pgtype.Float8OID, pgtype.JSONBOID:
+	case pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.JSONOID, pgtype.JSONBOID:
 		return bytes.Clone(value), nil
 
-	case pgtype.Int4ArrayOID:
-		result := make([]byte, len(value))
-		copy(result, value)
-		result[0] = '['
-		result[len(result)-1] = ']'
-		return result, nil
+	case pgtype.Float4OID, pgtype.Float8OID:
+		switch string(value) {
+		case "NaN", "Infinity", "-Infinity":
+			// No valid json numbers.
+			return json.Marshal(string(value))
+		}
+		return bytes.Clone(value), nil
 
 	case pgtype.BoolOID:
 		if string(value) == "t" {
@@ -264,118 +671,522 @@ func (p *FlowPostgres) convertValue(value []byte, oid uint32) ([]byte, error) {
 	case pgtype.NumericOID:
 		return fmt.Appendf(nil, `"%s"`, value), nil
 
-	case pgtype.TimestamptzOID:
-		timeValue, err := time.Parse("2006-01-02 15:04:05-07", string(value))
+	case pgtype.TimestamptzOID, pgtype.TimestampOID, pgtype.DateOID:
+		timeValue, err := parseTime(string(value), oid)
 		if err != nil {
 			return nil, fmt.Errorf("parsing time %s: %w", value, err)
 		}
 		return strconv.AppendInt(nil, timeValue.Unix(), 10), nil
 
-	case pgtype.VarcharArrayOID, pgtype.TextArrayOID:
-		strValue := strings.Trim(string(value), "{}")
-		if strValue == "" {
-			return []byte("[]"), nil
-		}
-		strArray := strings.Split(strValue, ",")
-		return json.Marshal(strArray)
-
 	default:
 		if _, ok := p.enums[oid]; ok {
 			return json.Marshal(string(value))
 		}
 
+		elementOID, ok := arrayElementOIDs[oid]
+		if !ok {
+			elementOID, ok = p.enumArrays[oid]
+		}
+		if ok {
+			return p.convertArray(value, elementOID)
+		}
+
 		return nil, fmt.Errorf("unsupported postgres type %d", oid)
 	}
 }
 
+// convertArray converts a postgres array to a json array. Each element is
+// converted with convertValue.
+func (p *FlowPostgres) convertArray(value []byte, elementOID uint32) ([]byte, error) {
+	elements, err := parseArray(value)
+	if err != nil {
+		return nil, fmt.Errorf("parsing array %s: %w", value, err)
+	}
+
+	result := []byte{'['}
+	for i, element := range elements {
+		if i > 0 {
+			result = append(result, ',')
+		}
+
+		if element == nil {
+			result = append(result, "null"...)
+			continue
+		}
+
+		converted, err := p.convertValue(element, elementOID)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		result = append(result, converted...)
+	}
+	return append(result, ']'), nil
+}
+
+// parseArray parses the text representation of a one dimensional postgres
+// array.
+//
+// NULL elements are returned as nil. Quoted elements are unescaped.
+func parseArray(value []byte) ([][]byte, error) {
+	if len(value) < 2 || value[0] != '{' || value[len(value)-1] != '}' {
+		return nil, fmt.Errorf("array has to start with { and end with }")
+	}
+
+	body := value[1 : len(value)-1]
+	elements := [][]byte{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return elements, nil
+	}
+
+	i := 0
+	skipSpace := func() {
+		for i < len(body) && body[i] == ' ' {
+			i++
+		}
+	}
+
+	for {
+		skipSpace()
+		if i == len(body) {
+			return nil, fmt.Errorf("missing element after ,")
+		}
+
+		switch body[i] {
+		case '{':
+			return nil, fmt.Errorf("multidimensional arrays are not supported")
+
+		case '"':
+			i++
+			element := []byte{}
+			for {
+				if i == len(body) {
+					return nil, fmt.Errorf("unterminated quoted element")
+				}
+
+				c := body[i]
+				i++
+
+				if c == '"' {
+					break
+				}
+
+				if c == '\\' {
+					if i == len(body) {
+						return nil, fmt.Errorf("unterminated escape sequence")
+					}
+					c = body[i]
+					i++
+				}
+				element = append(element, c)
+			}
+			elements = append(elements, element)
+
+		default:
+			start := i
+			for i < len(body) && body[i] != ',' {
+				i++
+			}
+
+			element := bytes.TrimSpace(body[start:i])
+			if strings.EqualFold(string(element), "NULL") {
+				element = nil
+			}
+			elements = append(elements, element)
+		}
+
+		skipSpace()
+		if i == len(body) {
+			return elements, nil
+		}
+
+		if body[i] != ',' {
+			return nil, fmt.Errorf("unexpected character %q at position %d", body[i], i+1)
+		}
+		i++
+	}
+}
+
+// parseTime parses the text representation of a postgres date, timestamp or
+// timestamptz. Values without a timezone are interpreted as UTC.
+func parseTime(value string, oid uint32) (time.Time, error) {
+	var layouts []string
+	switch oid {
+	case pgtype.DateOID:
+		layouts = []string{"2006-01-02"}
+	case pgtype.TimestampOID:
+		layouts = []string{"2006-01-02 15:04:05.999999999"}
+	default:
+		layouts = []string{
+			"2006-01-02 15:04:05.999999999-07",
+			"2006-01-02 15:04:05.999999999-07:00",
+			"2006-01-02 15:04:05.999999999-07:00:00",
+		}
+	}
+
+	var err error
+	for _, layout := range layouts {
+		var t time.Time
+		t, err = time.ParseInLocation(layout, value, time.UTC)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
 // Update listens on pg notify to fetch updates.
 func (p *FlowPostgres) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
+	p.UpdateWithPosition(ctx, func(_ uint64, data map[dskey.Key][]byte, err error) {
+		updateFn(data, err)
+	})
+}
+
+// UpdateWithPosition is like Update, but also returns the transaction id of
+// each update.
+//
+// If the connection to postgres is lost, the error is reported with updateFn
+// and a new connection is opened. All changes that happened while the
+// connection was down are read from the notify log. If the notify log does not
+// contain all missing changes, flow.ErrMissedUpdates is reported.
+//
+// UpdateWithPosition only returns, when the context is done.
+func (p *FlowPostgres) UpdateWithPosition(ctx context.Context, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	p.UpdateFromPosition(ctx, 0, updateFn)
+}
+
+// UpdateFromPosition is like UpdateWithPosition, but first sends all changes
+// from the notify log since the position. The position has to be a value from
+// ResumePosition.
+//
+// If the notify log does not contain the position anymore,
+// flow.ErrMissedUpdates is reported.
+func (p *FlowPostgres) UpdateFromPosition(ctx context.Context, position uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) {
+	const reconnectInterval = time.Second
+
+	replayFrom := position
+	for {
+		err := p.listen(ctx, &replayFrom, updateFn)
+		if ctx.Err() != nil {
+			return
+		}
+
+		updateFn(0, nil, err)
+
+		select {
+		case <-time.After(reconnectInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ResumePosition returns the lowest transaction id, that was maybe not sent to
+// the updateFn of UpdateWithPosition. It can be used with UpdateFromPosition
+// to continue the updates after a restart. Some changes from the position on
+// can be sent again, but none are skipped.
+//
+// Returns 0, if UpdateWithPosition was not called.
+func (p *FlowPostgres) ResumePosition() uint64 {
+	return p.resumePosition.Load()
+}
+
+// CoversPosition returns true, if the notify log contains all changes since
+// the position.
+//
+// An empty notify log covers every position. This is the normal state after
+// the log was cleaned up.
+func (p *FlowPostgres) CoversPosition(ctx context.Context, position uint64) (bool, error) {
 	conn, err := p.Pool.Acquire(ctx)
 	if err != nil {
-		updateFn(nil, fmt.Errorf("acquire connection: %w", err))
-		return
+		return false, fmt.Errorf("acquire connection: %w", err)
 	}
 	defer conn.Release()
 
+	return coversPosition(ctx, conn.Conn(), position)
+}
+
+func coversPosition(ctx context.Context, conn *pgx.Conn, position uint64) (bool, error) {
+	var covered bool
+	sql := `SELECT COALESCE(min(xact_id) <= $1::xid8, true) FROM os_notify_log_t;`
+	if err := conn.QueryRow(ctx, sql, position).Scan(&covered); err != nil {
+		return false, fmt.Errorf("checking notify log for position %d: %w", position, err)
+	}
+	return covered, nil
+}
+
+// listen opens a connection and listens for notifications until an error
+// happens.
+//
+// replayFrom is the lowest transaction id, that is maybe not processed yet. If
+// it is 0, only changes from now on are sent. listen updates the value while it
+// processes notifications.
+//
+// A notification only means, that there are new transactions. Their changes
+// are read from the notify log. A notification can be received later then
+// other notifications of higher transactions or get lost with the connection.
+// So the position can not be derived from the notifications.
+func (p *FlowPostgres) listen(ctx context.Context, replayFrom *uint64, updateFn func(uint64, map[dskey.Key][]byte, error)) error {
+	conn, err := p.Pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	if *replayFrom != 0 {
+		covered, err := coversPosition(ctx, conn.Conn(), *replayFrom)
+		if err != nil {
+			return err
+		}
+
+		if !covered {
+			updateFn(0, nil, fmt.Errorf("notify log does not contain position %d: %w", *replayFrom, flow.ErrMissedUpdates))
+			*replayFrom = 0
+		}
+	}
+
+	if *replayFrom == 0 {
+		// The position has to be read before LISTEN. Transactions, that end
+		// between both queries are only found in the notify log.
+		*replayFrom, err = currentXmin(ctx, conn.Conn())
+		if err != nil {
+			return err
+		}
+	}
+	p.resumePosition.Store(*replayFrom)
+
 	_, err = conn.Exec(ctx, "LISTEN os_notify")
 	if err != nil {
-		updateFn(nil, fmt.Errorf("listen on channel os_notify: %w", err))
-		return
+		return fmt.Errorf("listen on channel os_notify: %w", err)
 	}
 
+	// seen is the snapshot of the last read of the notify log. All
+	// transactions, that are visible in it, were sent to updateFn. At first,
+	// these are all transactions lower then replayFrom.
+	//
+	// Its size is limited by the amount of concurrent transactions, so a long
+	// running transaction does not let it grow.
+	seen := fmt.Sprintf("%d:%d:", *replayFrom, *replayFrom)
 	for {
-		notification, err := conn.Conn().WaitForNotification(ctx)
+		snapshot, xmin, xactIDs, values, err := p.newTransactions(ctx, conn.Conn(), seen)
 		if err != nil {
-			updateFn(nil, fmt.Errorf("wait for notification: %w", err))
-			return
+			return err
 		}
 
-		var payload struct {
-			XACTID int `json:"xactId"`
+		if len(xactIDs) > 0 {
+			p.raiseLastXactID(xactIDs[len(xactIDs)-1])
+			updateFn(xactIDs[len(xactIDs)-1], values, nil)
 		}
 
-		if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
-			updateFn(nil, fmt.Errorf("unmarshal notify payload: %w", err))
-			return
+		// All transactions lower then xmin were visible in the notify log, so
+		// they are sent.
+		*replayFrom = xmin
+		p.resumePosition.Store(xmin)
+		seen = snapshot
+
+		if err := p.waitForNotifications(ctx, conn.Conn()); err != nil {
+			return err
+		}
+	}
+}
+
+// newTransactions reads all transactions from the notify log, that are not
+// visible in the snapshot seen, and returns all their changes.
+//
+// It also returns the snapshot, that was used to read the notify log, its
+// xmin and the ids of the new transactions in ascending order.
+func (p *FlowPostgres) newTransactions(ctx context.Context, conn *pgx.Conn, seen string) (string, uint64, []uint64, map[dskey.Key][]byte, error) {
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("begin transaction: %w", err)
+	}
+	// The transaction is read only. There is nothing to commit.
+	defer tx.Rollback(ctx)
+
+	var snapshot string
+	var xmin uint64
+	if err := tx.QueryRow(ctx, `SELECT pg_current_snapshot()::text, pg_snapshot_xmin(pg_current_snapshot());`).Scan(&snapshot, &xmin); err != nil {
+		return "", 0, nil, nil, fmt.Errorf("reading current snapshot: %w", err)
+	}
+
+	sql := `SELECT DISTINCT xact_id FROM os_notify_log_t
+	WHERE xact_id >= pg_snapshot_xmin($1::pg_snapshot) AND NOT pg_visible_in_snapshot(xact_id, $1::pg_snapshot)
+	ORDER BY xact_id;`
+	rows, err := tx.Query(ctx, sql, seen)
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("query transactions after snapshot %s: %w", seen, err)
+	}
+
+	xactIDs, err := pgx.CollectRows(rows, pgx.RowTo[uint64])
+	if err != nil {
+		return "", 0, nil, nil, fmt.Errorf("parse transaction ids: %w", err)
+	}
+
+	if len(xactIDs) == 0 {
+		return snapshot, xmin, nil, nil, nil
+	}
+
+	values, err := p.transactionValues(ctx, tx, xactIDs)
+	if err != nil {
+		return "", 0, nil, nil, err
+	}
+
+	return snapshot, xmin, xactIDs, values, nil
+}
+
+// waitForNotifications blocks until there is a notification. Afterwards, it
+// collects more notifications until notifyMaxLatency has passed.
+func (p *FlowPostgres) waitForNotifications(ctx context.Context, conn *pgx.Conn) error {
+	if _, err := conn.WaitForNotification(ctx); err != nil {
+		return fmt.Errorf("wait for notification: %w", err)
+	}
+
+	if p.notifyMaxLatency <= 0 {
+		return nil
+	}
+
+	batchCtx, cancel := context.WithTimeout(ctx, p.notifyMaxLatency)
+	defer cancel()
+
+	for {
+		if _, err := conn.WaitForNotification(batchCtx); err != nil {
+			if batchCtx.Err() != nil && ctx.Err() == nil {
+				return nil
+			}
+			return fmt.Errorf("wait for notification: %w", err)
 		}
+	}
+}
+
+// transactionValues returns all keys, that where changed in the transactions,
+// with there current values.
+//
+// The notify log and the values are read with one query each, regardless of
+// the number of transactions.
+func (p *FlowPostgres) transactionValues(ctx context.Context, conn querier, xactIDs []uint64) (map[dskey.Key][]byte, error) {
+	dataColumn := "NULL::jsonb"
+	if p.fieldTypes != nil {
+		dataColumn = "data"
+	}
 
-		sql := `SELECT DISTINCT operation, fqid, updated_fields FROM os_notify_log_t WHERE xact_id = $1::xid8;`
-		rows, err := conn.Conn().Query(ctx, sql, payload.XACTID)
+	sql := fmt.Sprintf(
+		`SELECT DISTINCT operation, fqid, updated_fields, %s AS data FROM os_notify_log_t WHERE xact_id = ANY ($1::xid8[]);`,
+		dataColumn,
+	)
+	rows, err := conn.Query(ctx, sql, xactIDs)
+	if err != nil {
+		return nil, fmt.Errorf("query fqids for transactions %v: %w", xactIDs, err)
+	}
+
+	updateLogs, err := pgx.CollectRows(rows, pgx.RowToStructByName[struct {
+		Operation     string
+		Fqid          string
+		UpdatedFields []string
+		Data          map[string]*string
+	}])
+	if err != nil {
+		return nil, fmt.Errorf("parse notify_log: %w", err)
+	}
+
+	// The data of a row can only be used, if it is the only change of the
+	// object. Otherwise it is not clear, which change is the newest.
+	fqidCount := make(map[string]int, len(updateLogs))
+	for _, updateLog := range updateLogs {
+		fqidCount[updateLog.Fqid]++
+	}
+
+	values := make(map[dskey.Key][]byte)
+	var deletedKeys []dskey.Key
+	var updatedKeys []dskey.Key
+	for _, updateLog := range updateLogs {
+		collectionName, id, err := getCollectionNameAndID(updateLog.Fqid)
 		if err != nil {
-			updateFn(nil, fmt.Errorf("query fqids for transaction %d: %w", payload.XACTID, err))
-			return
+			return nil, fmt.Errorf("split fqid from %s: %w", updateLog.Fqid, err)
 		}
 
-		updateLogs, err := pgx.CollectRows(rows, pgx.RowToStructByName[struct {
-			Operation     string
-			Fqid          string
-			UpdatedFields []string
-		}])
+		keys, err := createKeyList(collectionName, id, updateLog.Operation, updateLog.UpdatedFields)
 		if err != nil {
-			updateFn(nil, fmt.Errorf("parse notify_log: %w", err))
-			return
+			return nil, fmt.Errorf("creating key list from notification: %w", err)
 		}
 
-		var deletedKeys []dskey.Key
-		var updatedKeys []dskey.Key
-		for _, updateLog := range updateLogs {
-			collectionName, id, err := getCollectionNameAndID(updateLog.Fqid)
-			if err != nil {
-				updateFn(nil, fmt.Errorf("split fqid from %s: %w", updateLog.Fqid, err))
-				return
+		switch updateLog.Operation {
+		case "delete":
+			deletedKeys = append(deletedKeys, keys...)
+		case "insert", "update":
+			if updateLog.Data == nil || fqidCount[updateLog.Fqid] > 1 {
+				updatedKeys = append(updatedKeys, keys...)
+				continue
 			}
 
-			keys, err := createKeyList(collectionName, id, updateLog.UpdatedFields)
-			if err != nil {
-				updateFn(nil, fmt.Errorf("creating key list from notification: %w", err))
-				return
-			}
+			for _, key := range keys {
+				value, found, err := p.valueFromLog(key, updateLog.Data)
+				if err != nil {
+					return nil, fmt.Errorf("convert value for %s from notify log: %w", key, err)
+				}
 
-			switch updateLog.Operation {
-			case "delete":
-				deletedKeys = append(deletedKeys, keys...)
-			case "insert", "update":
-				updatedKeys = append(updatedKeys, keys...)
+				if !found {
+					updatedKeys = append(updatedKeys, key)
+					continue
+				}
+				values[key] = value
 			}
 		}
+	}
 
-		// TODO: don't use getWithConn for insert operation
-		values, err := p.getWithConn(ctx, conn.Conn(), updatedKeys...)
-		if err != nil {
-			updateFn(nil, fmt.Errorf("fetching keys %v: %w", updatedKeys, err))
-			return
-		}
+	fetched, err := p.getWithConn(ctx, conn, updatedKeys...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys %v: %w", updatedKeys, err)
+	}
+	maps.Copy(values, fetched)
 
-		if values == nil && len(deletedKeys) != 0 {
-			values = map[dskey.Key][]byte{}
+	for _, key := range deletedKeys {
+		if _, ok := values[key]; ok {
+			// The key was deleted and written in different transactions. The
+			// fetched value is the current one.
+			continue
 		}
+		values[key] = nil
+	}
 
-		for _, key := range deletedKeys {
-			values[key] = nil
-		}
+	return values, nil
+}
+
+// valueFromLog returns the value of a key from the data of the notify log.
+//
+// Returns false, if the data does not contain the field. This happens for
+// fields, that are calculated in a view.
+func (p *FlowPostgres) valueFromLog(key dskey.Key, data map[string]*string) ([]byte, bool, error) {
+	oid, ok := p.fieldTypes[key.CollectionField()]
+	if !ok {
+		return nil, false, nil
+	}
+
+	value, ok := data[key.Field()]
+	if !ok {
+		return nil, false, nil
+	}
 
-		updateFn(values, nil)
+	if value == nil {
+		return nil, true, nil
 	}
+
+	converted, err := p.convertValue([]byte(*value), oid)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return converted, true, nil
+}
+
+// currentXmin returns the lowest transaction id, that is still running.
+func currentXmin(ctx context.Context, conn *pgx.Conn) (uint64, error) {
+	var xmin uint64
+	if err := conn.QueryRow(ctx, `SELECT pg_snapshot_xmin(pg_current_snapshot());`).Scan(&xmin); err != nil {
+		return 0, fmt.Errorf("reading current xmin: %w", err)
+	}
+	return xmin, nil
 }
 
 // WaitPostgresAvailable blocks until postgres db is availabe
@@ -384,9 +1195,9 @@ func WaitPostgresAvailable(lookup environment.Environmenter) error {
 		return nil
 	}
 
-	addr, err := postgresDSN(lookup)
+	addr, err := postgresDSN(lookup, envPostgresHost.Value(lookup), envPostgresPort.Value(lookup))
 	if err != nil {
-		return fmt.Errorf("reading postgres password: %w", err)
+		return fmt.Errorf("creating dsn: %w", err)
 	}
 
 	var conn *pgx.Conn
@@ -408,13 +1219,19 @@ func WaitPostgresAvailable(lookup environment.Environmenter) error {
 	}
 }
 
-func createKeyList(collection string, id int, fields []string) ([]dskey.Key, error) {
+func createKeyList(collection string, id int, operation string, fields []string) ([]dskey.Key, error) {
 	if len(fields) == 0 {
 		fields = collectionFields[collection]
 	}
 
 	keys := make([]dskey.Key, 0, len(fields))
 	for _, field := range fields {
+		if operation != "delete" && IsComputedField(collection+"/"+field) {
+			// Computed fields are updated by there own flow. But when the
+			// object is deleted, the field does not exist anymore.
+			continue
+		}
+
 		key, err := dskey.FromParts(collection, id, field)
 		if err != nil {
 			continue
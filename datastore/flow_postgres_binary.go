@@ -0,0 +1,281 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// postgresEpoch is 2000-01-01 as unix timestamp. Binary dates and timestamps
+// are relative to this date.
+const postgresEpoch = 946684800
+
+// convertField converts a value from postgres to json. It uses the format of
+// the field description.
+func (p *FlowPostgres) convertField(value []byte, fd pgconn.FieldDescription) ([]byte, error) {
+	if fd.Format == pgx.BinaryFormatCode {
+		return p.convertBinaryValue(value, fd.DataTypeOID)
+	}
+	return p.convertValue(value, fd.DataTypeOID)
+}
+
+// formatFloat formats a float like the text format of postgres. It uses the
+// shortest representation and only switches to the exponent format, when the
+// exponent is smaller then -4 or has at least 15 digits for float8 and 6 digits
+// for float4.
+//
+// NaN and infinite values are no valid json numbers. They are returned as
+// strings like postgres does it for json.
+func formatFloat(value float64, bitSize int) []byte {
+	switch {
+	case math.IsNaN(value):
+		return []byte(`"NaN"`)
+	case math.IsInf(value, 1):
+		return []byte(`"Infinity"`)
+	case math.IsInf(value, -1):
+		return []byte(`"-Infinity"`)
+	}
+
+	precision := 15
+	if bitSize == 32 {
+		precision = 6
+	}
+
+	exponentFormat := strconv.AppendFloat(nil, value, 'e', -1, bitSize)
+	exponent, err := strconv.Atoi(string(exponentFormat[bytes.IndexByte(exponentFormat, 'e')+1:]))
+	if err == nil && (exponent < -4 || exponent >= precision) {
+		return exponentFormat
+	}
+	return strconv.AppendFloat(nil, value, 'f', -1, bitSize)
+}
+
+// convertBinaryValue is like convertValue, but for the binary format of the
+// extended protocol.
+func (p *FlowPostgres) convertBinaryValue(value []byte, oid uint32) ([]byte, error) {
+	switch oid {
+	case pgtype.VarcharOID, pgtype.TextOID, pgtype.BPCharOID:
+		return json.Marshal(string(value))
+
+	case pgtype.Int2OID:
+		if len(value) != 2 {
+			return nil, fmt.Errorf("invalid length %d for int2", len(value))
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.BigEndian.Uint16(value))), 10), nil
+
+	case pgtype.Int4OID:
+		if len(value) != 4 {
+			return nil, fmt.Errorf("invalid length %d for int4", len(value))
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.BigEndian.Uint32(value))), 10), nil
+
+	case pgtype.Int8OID:
+		if len(value) != 8 {
+			return nil, fmt.Errorf("invalid length %d for int8", len(value))
+		}
+		return strconv.AppendInt(nil, int64(binary.BigEndian.Uint64(value)), 10), nil
+
+	case pgtype.Float4OID:
+		if len(value) != 4 {
+			return nil, fmt.Errorf("invalid length %d for float4", len(value))
+		}
+		return formatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 32), nil
+
+	case pgtype.Float8OID:
+		if len(value) != 8 {
+			return nil, fmt.Errorf("invalid length %d for float8", len(value))
+		}
+		return formatFloat(math.Float64frombits(binary.BigEndian.Uint64(value)), 64), nil
+
+	case pgtype.BoolOID:
+		if len(value) != 1 {
+			return nil, fmt.Errorf("invalid length %d for bool", len(value))
+		}
+		if value[0] == 1 {
+			return []byte("true"), nil
+		}
+		return []byte("false"), nil
+
+	case pgtype.JSONOID:
+		return []byte(string(value)), nil
+
+	case pgtype.JSONBOID:
+		if len(value) == 0 || value[0] != 1 {
+			return nil, fmt.Errorf("unsupported jsonb version")
+		}
+		return []byte(string(value[1:])), nil
+
+	case pgtype.NumericOID:
+		numeric, err := decodeBinaryNumeric(value)
+		if err != nil {
+			return nil, fmt.Errorf("decoding numeric: %w", err)
+		}
+		return json.Marshal(numeric)
+
+	case pgtype.TimestamptzOID, pgtype.TimestampOID:
+		if len(value) != 8 {
+			return nil, fmt.Errorf("invalid length %d for timestamp", len(value))
+		}
+		microseconds := int64(binary.BigEndian.Uint64(value))
+		if microseconds == math.MaxInt64 || microseconds == math.MinInt64 {
+			return nil, fmt.Errorf("infinite timestamp")
+		}
+		// Use floor division, so times before 2000 are rounded down like in
+		// the text format.
+		seconds := microseconds / 1_000_000
+		if microseconds%1_000_000 < 0 {
+			seconds--
+		}
+		return strconv.AppendInt(nil, seconds+postgresEpoch, 10), nil
+
+	case pgtype.DateOID:
+		if len(value) != 4 {
+			return nil, fmt.Errorf("invalid length %d for date", len(value))
+		}
+		days := int64(int32(binary.BigEndian.Uint32(value)))
+		if days == math.MaxInt32 || days == math.MinInt32 {
+			return nil, fmt.Errorf("infinite date")
+		}
+		return strconv.AppendInt(nil, days*24*60*60+postgresEpoch, 10), nil
+
+	default:
+		if _, ok := p.enums[oid]; ok {
+			return json.Marshal(string(value))
+		}
+
+		elementOID, ok := arrayElementOIDs[oid]
+		if !ok {
+			elementOID, ok = p.enumArrays[oid]
+		}
+		if ok {
+			return p.convertBinaryArray(value, elementOID)
+		}
+
+		return nil, fmt.Errorf("unsupported postgres type %d", oid)
+	}
+}
+
+// convertBinaryArray converts a one dimensional postgres array in binary format
+// to a json array.
+func (p *FlowPostgres) convertBinaryArray(value []byte, elementOID uint32) ([]byte, error) {
+	if len(value) < 12 {
+		return nil, fmt.Errorf("array header too short")
+	}
+
+	dimensions := binary.BigEndian.Uint32(value[0:])
+	if dimensions == 0 {
+		return []byte("[]"), nil
+	}
+
+	if dimensions != 1 {
+		return nil, fmt.Errorf("multidimensional arrays are not supported")
+	}
+
+	if len(value) < 20 {
+		return nil, fmt.Errorf("array header too short")
+	}
+
+	length := int(int32(binary.BigEndian.Uint32(value[12:])))
+	rest := value[20:]
+
+	result := []byte{'['}
+	for i := range length {
+		if i > 0 {
+			result = append(result, ',')
+		}
+
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("array element %d is missing", i)
+		}
+		elementLength := int(int32(binary.BigEndian.Uint32(rest)))
+		rest = rest[4:]
+
+		if elementLength == -1 {
+			result = append(result, "null"...)
+			continue
+		}
+
+		if len(rest) < elementLength {
+			return nil, fmt.Errorf("array element %d is too short", i)
+		}
+
+		converted, err := p.convertBinaryValue(rest[:elementLength], elementOID)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		result = append(result, converted...)
+		rest = rest[elementLength:]
+	}
+	return append(result, ']'), nil
+}
+
+// decodeBinaryNumeric returns the text representation of a numeric in binary
+// format. It is the same as the text format of postgres.
+func decodeBinaryNumeric(value []byte) (string, error) {
+	if len(value) < 8 {
+		return "", fmt.Errorf("numeric header too short")
+	}
+
+	digitCount := int(binary.BigEndian.Uint16(value[0:]))
+	weight := int(int16(binary.BigEndian.Uint16(value[2:])))
+	sign := binary.BigEndian.Uint16(value[4:])
+	scale := int(binary.BigEndian.Uint16(value[6:]))
+
+	switch sign {
+	case 0x0000, 0x4000:
+	case 0xC000:
+		return "NaN", nil
+	case 0xD000:
+		return "Infinity", nil
+	case 0xF000:
+		return "-Infinity", nil
+	default:
+		return "", fmt.Errorf("invalid sign %x", sign)
+	}
+
+	if len(value) != 8+digitCount*2 {
+		return "", fmt.Errorf("invalid length %d for %d digits", len(value), digitCount)
+	}
+
+	// Each digit is a number between 0 and 9999. The first digit is multiplied
+	// with 10000^weight.
+	digit := func(i int) int {
+		if i < 0 || i >= digitCount {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(value[8+i*2:]))
+	}
+
+	var sb strings.Builder
+	if sign == 0x4000 {
+		sb.WriteByte('-')
+	}
+
+	if weight < 0 {
+		sb.WriteByte('0')
+	} else {
+		sb.WriteString(strconv.Itoa(digit(0)))
+		for i := 1; i <= weight; i++ {
+			fmt.Fprintf(&sb, "%04d", digit(i))
+		}
+	}
+
+	if scale > 0 {
+		var fraction strings.Builder
+		for i := weight + 1; fraction.Len() < scale; i++ {
+			fmt.Fprintf(&fraction, "%04d", digit(i))
+		}
+
+		sb.WriteByte('.')
+		sb.WriteString(fraction.String()[:scale])
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,82 @@
+package datastore_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestConvertBinaryValue(t *testing.T) {
+	typeMap := pgtype.NewMap()
+	flow := new(datastore.FlowPostgres)
+
+	numeric := func(s string) pgtype.Numeric {
+		var n pgtype.Numeric
+		if err := n.Scan(s); err != nil {
+			t.Fatalf("parsing numeric %s: %v", s, err)
+		}
+		return n
+	}
+
+	str := func(s string) *string { return &s }
+
+	for _, tt := range []struct {
+		name   string
+		oid    uint32
+		value  any
+		expect string
+	}{
+		{"text", pgtype.TextOID, "hello", `"hello"`},
+		{"varchar with quotes", pgtype.VarcharOID, `say "hi"`, `"say \"hi\""`},
+		{"int2", pgtype.Int2OID, int16(-42), `-42`},
+		{"int4", pgtype.Int4OID, int32(42), `42`},
+		{"int8", pgtype.Int8OID, int64(9007199254740991), `9007199254740991`},
+		{"float4", pgtype.Float4OID, float32(7.5), `7.5`},
+		{"float8", pgtype.Float8OID, 7.5, `7.5`},
+		{"float8 million", pgtype.Float8OID, 1e6, `1000000`},
+		{"float8 big", pgtype.Float8OID, 1e15, `1e+15`},
+		{"float8 small", pgtype.Float8OID, 0.0001, `0.0001`},
+		{"float8 very small", pgtype.Float8OID, 0.00001, `1e-05`},
+		{"float8 NaN", pgtype.Float8OID, math.NaN(), `"NaN"`},
+		{"float8 infinity", pgtype.Float8OID, math.Inf(1), `"Infinity"`},
+		{"float8 negative infinity", pgtype.Float8OID, math.Inf(-1), `"-Infinity"`},
+		{"float4 big", pgtype.Float4OID, float32(1e6), `1e+06`},
+		{"float4 NaN", pgtype.Float4OID, float32(math.NaN()), `"NaN"`},
+		{"bool true", pgtype.BoolOID, true, `true`},
+		{"bool false", pgtype.BoolOID, false, `false`},
+		{"jsonb", pgtype.JSONBOID, map[string]int{"a": 1}, `{"a":1}`},
+		{"numeric", pgtype.NumericOID, numeric("1.500000"), `"1.500000"`},
+		{"numeric integer", pgtype.NumericOID, numeric("123456789"), `"123456789"`},
+		{"numeric zero", pgtype.NumericOID, numeric("0"), `"0"`},
+		{"numeric small", pgtype.NumericOID, numeric("-0.000012"), `"-0.000012"`},
+		{"numeric big fraction", pgtype.NumericOID, numeric("12345678.9"), `"12345678.9"`},
+		{"timestamptz", pgtype.TimestamptzOID, time.Date(1999, 1, 8, 0, 0, 0, 0, time.UTC), `915753600`},
+		{"timestamptz before 2000 with fraction", pgtype.TimestamptzOID, time.Date(1999, 1, 8, 0, 0, 0, 500_000_000, time.UTC), `915753600`},
+		{"timestamp", pgtype.TimestampOID, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), `1704164645`},
+		{"date", pgtype.DateOID, time.Date(1999, 1, 8, 0, 0, 0, 0, time.UTC), `915753600`},
+		{"int4 array", pgtype.Int4ArrayOID, []int32{1, 2, 3}, `[1,2,3]`},
+		{"int4 array empty", pgtype.Int4ArrayOID, []int32{}, `[]`},
+		{"text array", pgtype.TextArrayOID, []*string{str("a,b"), nil, str("{}")}, `["a,b",null,"{}"]`},
+		{"numeric array", pgtype.NumericArrayOID, []pgtype.Numeric{numeric("1.5")}, `["1.5"]`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := typeMap.Encode(tt.oid, pgx.BinaryFormatCode, tt.value, nil)
+			if err != nil {
+				t.Fatalf("encoding value: %v", err)
+			}
+
+			got, err := flow.ConvertBinaryValue(encoded, tt.oid)
+			if err != nil {
+				t.Fatalf("ConvertBinaryValue: %v", err)
+			}
+
+			if string(got) != tt.expect {
+				t.Errorf("got %s, expected %s", got, tt.expect)
+			}
+		})
+	}
+}
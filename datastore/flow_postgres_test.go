@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -399,3 +400,882 @@ func TestBigQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestFlowPostgresSnapshot(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Postgres Test")
+	}
+
+	ctx := t.Context()
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	conn, err := tp.Conn(ctx)
+	if err != nil {
+		t.Fatalf("create connection: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	env := environment.ForTests(tp.Env)
+	env["DATABASE_SNAPSHOT_READ"] = "true"
+	flow, err := datastore.NewFlowPostgres(env)
+	if err != nil {
+		t.Fatalf("NewFlowPostgres(): %v", err)
+	}
+	defer flow.Close()
+
+	sql := `
+	INSERT INTO "user" (id, username) VALUES (42, 'hugo');
+	INSERT INTO theme (id, name) VALUES (42, 'other theme');
+	`
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		t.Fatalf("adding example data: %v", err)
+	}
+
+	keys := []dskey.Key{
+		dskey.MustKey("user/42/username"),
+		dskey.MustKey("theme/42/name"),
+	}
+
+	got, position, err := flow.GetSnapshot(ctx, keys...)
+	if err != nil {
+		t.Fatalf("GetSnapshot: %v", err)
+	}
+
+	expect := map[dskey.Key][]byte{
+		keys[0]: []byte(`"hugo"`),
+		keys[1]: []byte(`"other theme"`),
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("\nGot\t\t%v\nexpect\t%v", got, expect)
+	}
+
+	if position == 0 {
+		t.Errorf("GetSnapshot returned position 0")
+	}
+
+	var updateXactID uint64
+	updateSQL := `WITH u AS (UPDATE "user" SET username = 'hans' WHERE id = 42) SELECT pg_current_xact_id()::text::bigint;`
+	if err := conn.QueryRow(ctx, updateSQL).Scan(&updateXactID); err != nil {
+		t.Fatalf("updating example data: %v", err)
+	}
+
+	got, err = flow.Get(ctx, keys[0])
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if string(got[keys[0]]) != `"hans"` {
+		t.Errorf("Get after update returned %s, expected \"hans\"", got[keys[0]])
+	}
+
+	_, newPosition, err := flow.GetSnapshot(ctx, keys...)
+	if err != nil {
+		t.Fatalf("second GetSnapshot: %v", err)
+	}
+
+	if newPosition < updateXactID {
+		t.Errorf("position after update is %d, expected at least the transaction id %d of the update", newPosition, updateXactID)
+	}
+
+	// The position of a snapshot means the same as the position of an update.
+	if _, err := flow.GetAtPosition(ctx, newPosition, keys...); err != nil {
+		t.Errorf("GetAtPosition with the position of GetSnapshot: %v", err)
+	}
+}
+
+func TestPostgresUpdateWithPosition(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	defer cancel()
+
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Postgres Test")
+	}
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	conn, err := tp.Conn(ctx)
+	if err != nil {
+		t.Fatalf("create connection: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	flow, err := datastore.NewFlowPostgres(environment.ForTests(tp.Env))
+	if err != nil {
+		t.Fatalf("NewFlowPostgres(): %v", err)
+	}
+	defer flow.Close()
+
+	positions := make(chan uint64, 1)
+	go flow.UpdateWithPosition(ctx, func(position uint64, _ map[dskey.Key][]byte, err error) {
+		if err != nil {
+			t.Errorf("from Update callback: %v", err)
+			return
+		}
+
+		select {
+		case positions <- position:
+		default:
+		}
+	})
+	// TODO: How to do this without a sleep?
+	time.Sleep(5 * time.Second)
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("begin transaction: %v", err)
+	}
+
+	if _, err := tx.Exec(ctx, `INSERT INTO "user" (id, username) VALUES (300,'hugo');`); err != nil {
+		t.Fatalf("adding example data: %v", err)
+	}
+
+	var xactID uint64
+	if err := tx.QueryRow(ctx, `SELECT pg_current_xact_id();`).Scan(&xactID); err != nil {
+		t.Fatalf("reading transaction id: %v", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	key := dskey.MustKey("user/300/username")
+	got, err := flow.GetAtPosition(ctx, xactID, key)
+	if err != nil {
+		t.Fatalf("GetAtPosition: %v", err)
+	}
+
+	if string(got[key]) != `"hugo"` {
+		t.Errorf("GetAtPosition returned %s, expected \"hugo\"", got[key])
+	}
+
+	select {
+	case position := <-positions:
+		if position != xactID {
+			t.Errorf("UpdateWithPosition returned position %d, expected %d", position, xactID)
+		}
+	case <-ctx.Done():
+		t.Errorf("no update received: %v", ctx.Err())
+	}
+}
+
+func TestPostgresUpdateAfterConnectionLoss(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	defer cancel()
+
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Postgres Test")
+	}
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	conn, err := tp.Conn(ctx)
+	if err != nil {
+		t.Fatalf("create connection: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	flow, err := datastore.NewFlowPostgres(environment.ForTests(tp.Env))
+	if err != nil {
+		t.Fatalf("NewFlowPostgres(): %v", err)
+	}
+	defer flow.Close()
+
+	key := dskey.MustKey("user/300/username")
+
+	found := make(chan struct{})
+	var foundOnce sync.Once
+	go flow.Update(ctx, func(m map[dskey.Key][]byte, err error) {
+		if err != nil {
+			// The error from the terminated connection is expected.
+			return
+		}
+
+		if m[key] != nil {
+			foundOnce.Do(func() { close(found) })
+		}
+	})
+	// TODO: How to do this without a sleep?
+	time.Sleep(5 * time.Second)
+
+	// Close the listening connection and write data, before the flow can
+	// reconnect.
+	sql := `
+	SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = current_database() AND pid <> pg_backend_pid();
+	INSERT INTO "user" (id, username) VALUES (300,'hugo');
+	`
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		t.Fatalf("terminate connection and add data: %v", err)
+	}
+
+	select {
+	case <-found:
+	case <-ctx.Done():
+		t.Errorf("changes from the time without connection where not replayed")
+	}
+}
+
+func TestPostgresUpdateConnectionLossWithQueuedNotification(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	defer cancel()
+
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Postgres Test")
+	}
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	conn, err := tp.Conn(ctx)
+	if err != nil {
+		t.Fatalf("create connection: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	slowConn, err := tp.Conn(ctx)
+	if err != nil {
+		t.Fatalf("create second connection: %v", err)
+	}
+	defer slowConn.Close(ctx)
+
+	flow, err := datastore.NewFlowPostgres(environment.ForTests(tp.Env))
+	if err != nil {
+		t.Fatalf("NewFlowPostgres(): %v", err)
+	}
+	defer flow.Close()
+
+	slowKey := dskey.MustKey("user/301/username")
+	fastKey := dskey.MustKey("user/302/username")
+
+	// The listener blocks in the update of the fast transaction, so the
+	// notification of the slow transaction stays unread.
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	found := make(chan struct{})
+	var blockedOnce, foundOnce sync.Once
+	go flow.Update(ctx, func(m map[dskey.Key][]byte, err error) {
+		if err != nil {
+			// The error from the terminated connection is expected.
+			return
+		}
+
+		if m[fastKey] != nil && m[slowKey] == nil {
+			blockedOnce.Do(func() { close(blocked) })
+			<-release
+		}
+
+		if m[slowKey] != nil {
+			foundOnce.Do(func() { close(found) })
+		}
+	})
+	// TODO: How to do this without a sleep?
+	time.Sleep(5 * time.Second)
+
+	// The slow transaction gets a lower transaction id, but commits after the
+	// fast transaction.
+	slowTx, err := slowConn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("begin slow transaction: %v", err)
+	}
+	defer slowTx.Rollback(ctx)
+
+	if _, err := slowTx.Exec(ctx, `INSERT INTO "user" (id, username) VALUES (301, 'slow');`); err != nil {
+		t.Fatalf("insert in slow transaction: %v", err)
+	}
+
+	if _, err := conn.Exec(ctx, `INSERT INTO "user" (id, username) VALUES (302, 'fast');`); err != nil {
+		t.Fatalf("insert in fast transaction: %v", err)
+	}
+
+	select {
+	case <-blocked:
+	case <-ctx.Done():
+		t.Fatalf("fast transaction was not sent")
+	}
+
+	if err := slowTx.Commit(ctx); err != nil {
+		t.Fatalf("commit slow transaction: %v", err)
+	}
+
+	sql := `SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = current_database() AND pid <> pg_backend_pid();`
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		t.Fatalf("terminate connections: %v", err)
+	}
+	close(release)
+
+	select {
+	case <-found:
+	case <-ctx.Done():
+		t.Errorf("transaction with a queued notification was lost with the connection")
+	}
+}
+
+func BenchmarkPostgresUpdate(b *testing.B) {
+	if testing.Short() {
+		b.Skip("Postgres Test")
+	}
+
+	ctx := b.Context()
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		b.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	for _, latency := range []string{"0", "20ms"} {
+		b.Run("latency="+latency, func(b *testing.B) {
+			ctx, cancel := context.WithCancel(b.Context())
+			defer cancel()
+
+			env := environment.ForTests(tp.Env)
+			env["DATABASE_NOTIFY_MAX_LATENCY"] = latency
+			flow, err := datastore.NewFlowPostgres(env)
+			if err != nil {
+				b.Fatalf("NewFlowPostgres(): %v", err)
+			}
+			defer flow.Close()
+
+			conn, err := tp.Conn(ctx)
+			if err != nil {
+				b.Fatalf("create connection: %v", err)
+			}
+			defer conn.Close(ctx)
+
+			var idOffset int
+			if err := conn.QueryRow(ctx, `SELECT COALESCE(max(id), 0) FROM "user";`).Scan(&idOffset); err != nil {
+				b.Fatalf("reading max user id: %v", err)
+			}
+
+			received := make(chan int, 1)
+			go flow.Update(ctx, func(m map[dskey.Key][]byte, err error) {
+				if err != nil {
+					return
+				}
+
+				var count int
+				for key, value := range m {
+					if key.Field() == "username" && value != nil {
+						count++
+					}
+				}
+				// The benchmark stops reading, when all users are received.
+				select {
+				case received <- count:
+				case <-ctx.Done():
+				}
+			})
+			// TODO: How to do this without a sleep?
+			time.Sleep(time.Second)
+
+			b.ResetTimer()
+			go func() {
+				for i := range b.N {
+					id := idOffset + i + 1
+					sql := fmt.Sprintf(`INSERT INTO "user" (id, username) VALUES (%d, 'user_%d');`, id, id)
+					if _, err := conn.Exec(ctx, sql); err != nil {
+						b.Errorf("adding user %d: %v", id, err)
+						return
+					}
+				}
+			}()
+
+			for got := 0; got < b.N; {
+				select {
+				case count := <-received:
+					got += count
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFlowPostgresGet(b *testing.B) {
+	if testing.Short() {
+		b.Skip("Postgres Test")
+	}
+
+	ctx := b.Context()
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		b.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	const userCount = 1000
+	sql := fmt.Sprintf(
+		`INSERT INTO "user" (id, username, first_name, is_active, default_vote_weight)
+		SELECT i, 'user_' || i, 'first_' || i, true, '1.000000' FROM generate_series(100, %d) AS i;`,
+		100+userCount-1,
+	)
+	conn, err := tp.Conn(ctx)
+	if err != nil {
+		b.Fatalf("create connection: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		b.Fatalf("adding users: %v", err)
+	}
+
+	var keys []dskey.Key
+	for id := 100; id < 100+userCount; id++ {
+		for _, field := range []string{"username", "first_name", "is_active", "default_vote_weight"} {
+			keys = append(keys, dskey.MustKeyf("user/%d/%s", id, field))
+		}
+	}
+
+	for _, mode := range []string{"simple", "prepared"} {
+		b.Run("mode="+mode, func(b *testing.B) {
+			env := environment.ForTests(tp.Env)
+			env["DATABASE_QUERY_MODE"] = mode
+			flow, err := datastore.NewFlowPostgres(env)
+			if err != nil {
+				b.Fatalf("NewFlowPostgres(): %v", err)
+			}
+			defer flow.Close()
+
+			b.ResetTimer()
+			for range b.N {
+				if _, err := flow.Get(ctx, keys...); err != nil {
+					b.Fatalf("Get: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestPostgresUpdateWithNotifyLogData(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	defer cancel()
+
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Postgres Test")
+	}
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	if err := tp.EnableNotifyLogData(ctx); err != nil {
+		t.Fatalf("enable notify log data: %v", err)
+	}
+
+	conn, err := tp.Conn(ctx)
+	if err != nil {
+		t.Fatalf("create connection: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, `INSERT INTO "user" (id, username) VALUES (300,'hugo');`); err != nil {
+		t.Fatalf("adding example data: %v", err)
+	}
+
+	flow, err := datastore.NewFlowPostgres(environment.ForTests(tp.Env))
+	if err != nil {
+		t.Fatalf("NewFlowPostgres(): %v", err)
+	}
+	defer flow.Close()
+
+	updates := make(chan map[dskey.Key][]byte, 1)
+	go flow.Update(ctx, func(m map[dskey.Key][]byte, err error) {
+		if err != nil {
+			t.Errorf("from Update callback: %v", err)
+			return
+		}
+		updates <- m
+	})
+	// TODO: How to do this without a sleep?
+	time.Sleep(5 * time.Second)
+
+	sql := `UPDATE "user" SET first_name = 'Hugo', default_vote_weight = 1.5, last_login = '1999-01-08' WHERE id = 300;`
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		t.Fatalf("updating example data: %v", err)
+	}
+
+	var got map[dskey.Key][]byte
+	select {
+	case got = <-updates:
+	case <-ctx.Done():
+		t.Fatalf("no update received: %v", ctx.Err())
+	}
+
+	expect := map[string]string{
+		"user/300/first_name":          `"Hugo"`,
+		"user/300/default_vote_weight": `"1.500000"`,
+		"user/300/last_login":          `915753600`,
+	}
+	for k, v := range expect {
+		if string(got[dskey.MustKey(k)]) != v {
+			t.Errorf("update for %s is %s, expected %s", k, got[dskey.MustKey(k)], v)
+		}
+	}
+}
+
+func TestFlowPostgresConvertValue(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Postgres Test")
+	}
+
+	ctx := t.Context()
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	conn, err := tp.Conn(ctx)
+	if err != nil {
+		t.Fatalf("create connection: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	// The enum has to exist before the flow is created.
+	if _, err := conn.Exec(ctx, `CREATE TYPE test_mood AS ENUM ('happy', 'sad');`); err != nil {
+		t.Fatalf("creating enum: %v", err)
+	}
+
+	for _, mode := range []string{"simple", "prepared"} {
+		t.Run(mode, func(t *testing.T) {
+			env := environment.ForTests(tp.Env)
+			env["DATABASE_QUERY_MODE"] = mode
+			flow, err := datastore.NewFlowPostgres(env)
+			if err != nil {
+				t.Fatalf("NewFlowPostgres(): %v", err)
+			}
+			defer flow.Close()
+
+			testConvertValue(t, flow)
+		})
+	}
+}
+
+func testConvertValue(t *testing.T, flow *datastore.FlowPostgres) {
+	ctx := t.Context()
+
+	for _, tt := range []struct {
+		name   string
+		value  string // sql expression
+		expect string
+	}{
+		{"varchar", `'hello'::varchar`, `"hello"`},
+		{"text with quotes", `'say "hi"'::text`, `"say \"hi\""`},
+		{"int2", `42::int2`, `42`},
+		{"int4", `42::int4`, `42`},
+		{"int8", `9007199254740991::int8`, `9007199254740991`},
+		{"float8", `7.5::float8`, `7.5`},
+		{"float8 million", `1e6::float8`, `1000000`},
+		{"float8 NaN", `'NaN'::float8`, `"NaN"`},
+		{"float8 infinity", `'-Infinity'::float8`, `"-Infinity"`},
+		{"bool", `true`, `true`},
+		{"numeric", `1.5::decimal(16,6)`, `"1.500000"`},
+		{"jsonb", `'{"a": 1}'::jsonb`, `{"a": 1}`},
+		{"date", `'1999-01-08'::date`, `915753600`},
+		{"timestamp", `'1999-01-08 00:00:00'::timestamp`, `915753600`},
+		{"timestamptz", `'1999-01-08 00:00:00+00'::timestamptz`, `915753600`},
+		{"timestamptz with fraction", `'1999-01-08 00:00:00.5+00'::timestamptz`, `915753600`},
+		{"enum", `'happy'::test_mood`, `"happy"`},
+		{"int array", `'{1,2,3}'::int4[]`, `[1,2,3]`},
+		{"int array empty", `'{}'::int4[]`, `[]`},
+		{"int8 array with null", `'{1,NULL}'::int8[]`, `[1,null]`},
+		{"decimal array", `'{1.5,2}'::decimal(16,6)[]`, `["1.500000","2.000000"]`},
+		{"text array", `'{a,b}'::text[]`, `["a","b"]`},
+		{"text array with comma", `ARRAY['a,b', 'c']::text[]`, `["a,b","c"]`},
+		{"text array with braces", `ARRAY['{a}', '}']::text[]`, `["{a}","}"]`},
+		{"text array with quotes", `ARRAY['say "hi"', 'back\slash']::text[]`, `["say \"hi\"","back\\slash"]`},
+		{"text array with null", `ARRAY['a', NULL, 'NULL']::text[]`, `["a",null,"NULL"]`},
+		{"text array with empty string", `ARRAY['', ' ']::text[]`, `[""," "]`},
+		{"varchar array", `'{a,b}'::varchar[]`, `["a","b"]`},
+		{"enum array", `'{happy,sad}'::test_mood[]`, `["happy","sad"]`},
+		{"bool array", `'{t,f}'::bool[]`, `[true,false]`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := flow.Pool.Query(ctx, "SELECT "+tt.value)
+			if err != nil {
+				t.Fatalf("query: %v", err)
+			}
+			defer rows.Close()
+
+			if !rows.Next() {
+				t.Fatalf("query returned no row: %v", rows.Err())
+			}
+
+			got, err := flow.ConvertField(rows.RawValues()[0], rows.FieldDescriptions()[0])
+			if err != nil {
+				t.Fatalf("ConvertField: %v", err)
+			}
+
+			if string(got) != tt.expect {
+				t.Errorf("got %s, expected %s", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestPostgresPoolConfig(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		config, err := datastore.PostgresPoolConfig(environment.ForTests{}, "localhost", "5432")
+		if err != nil {
+			t.Fatalf("PostgresPoolConfig: %v", err)
+		}
+
+		if config.MaxConnLifetime != time.Hour {
+			t.Errorf("MaxConnLifetime = %s, expected 1h", config.MaxConnLifetime)
+		}
+
+		if got := config.ConnConfig.RuntimeParams["statement_timeout"]; got != "0" {
+			t.Errorf("statement_timeout = %s, expected 0", got)
+		}
+	})
+
+	t.Run("custom", func(t *testing.T) {
+		config, err := datastore.PostgresPoolConfig(environment.ForTests{
+			"DATABASE_MAX_CONNS":           "20",
+			"DATABASE_MIN_CONNS":           "2",
+			"DATABASE_MAX_CONN_LIFETIME":   "10m",
+			"DATABASE_MAX_CONN_IDLE_TIME":  "60",
+			"DATABASE_HEALTH_CHECK_PERIOD": "5s",
+			"DATABASE_STATEMENT_TIMEOUT":   "2s",
+			"DATABASE_SSL_MODE":            "disable",
+		}, "localhost", "5432")
+		if err != nil {
+			t.Fatalf("PostgresPoolConfig: %v", err)
+		}
+
+		if config.MaxConns != 20 || config.MinConns != 2 {
+			t.Errorf("conns = %d-%d, expected 2-20", config.MinConns, config.MaxConns)
+		}
+
+		if config.MaxConnLifetime != 10*time.Minute || config.MaxConnIdleTime != time.Minute || config.HealthCheckPeriod != 5*time.Second {
+			t.Errorf("durations = %s, %s, %s, expected 10m, 1m, 5s", config.MaxConnLifetime, config.MaxConnIdleTime, config.HealthCheckPeriod)
+		}
+
+		if got := config.ConnConfig.RuntimeParams["statement_timeout"]; got != "2000" {
+			t.Errorf("statement_timeout = %s, expected 2000", got)
+		}
+
+		if config.ConnConfig.TLSConfig != nil {
+			t.Errorf("TLS config is set with sslmode disable")
+		}
+	})
+
+	for _, tt := range []struct {
+		name string
+		env  environment.ForTests
+	}{
+		{"invalid max conns", environment.ForTests{"DATABASE_MAX_CONNS": "many"}},
+		{"min conns greater then max conns", environment.ForTests{"DATABASE_MAX_CONNS": "2", "DATABASE_MIN_CONNS": "3"}},
+		{"invalid lifetime", environment.ForTests{"DATABASE_MAX_CONN_LIFETIME": "forever"}},
+		{"invalid statement timeout", environment.ForTests{"DATABASE_STATEMENT_TIMEOUT": "soon"}},
+		{"invalid sslmode", environment.ForTests{"DATABASE_SSL_MODE": "sometimes"}},
+		{"missing root cert", environment.ForTests{"DATABASE_SSL_MODE": "verify-full", "DATABASE_SSL_ROOT_CERT_FILE": "/does/not/exist"}},
+		{"invalid query mode", environment.ForTests{"DATABASE_QUERY_MODE": "fast"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := datastore.PostgresPoolConfig(tt.env, "localhost", "5432"); err == nil {
+				t.Errorf("PostgresPoolConfig returned no error")
+			}
+		})
+	}
+}
+
+func TestParseReplicaHosts(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		value   string
+		expect  []string
+		wantErr bool
+	}{
+		{"empty", "", []string{}, false},
+		{"host only", "replica1", []string{"replica1:5432"}, false},
+		{"host and port", "replica1:6432", []string{"replica1:6432"}, false},
+		{"many", "replica1, replica2:6432,", []string{"replica1:5432", "replica2:6432"}, false},
+		{"ipv6", "[::1]:6432", []string{"[::1]:6432"}, false},
+		{"empty port", "replica1:", nil, true},
+		{"empty host", ":6432", nil, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := datastore.ParseReplicaHosts(tt.value, "5432")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseReplicaHosts returned no error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseReplicaHosts: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("got %v, expected %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestFlowPostgresReplica(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	defer cancel()
+
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Postgres Test")
+	}
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	// The primary is also used as replica. So the replica is never behind.
+	env := environment.ForTests(tp.Env)
+	env["DATABASE_REPLICA_HOSTS"] = tp.Env["DATABASE_HOST"] + ":" + tp.Env["DATABASE_PORT"]
+	flow, err := datastore.NewFlowPostgres(env)
+	if err != nil {
+		t.Fatalf("NewFlowPostgres(): %v", err)
+	}
+	defer flow.Close()
+
+	received := make(chan struct{}, 1)
+	go flow.Update(ctx, func(m map[dskey.Key][]byte, err error) {
+		if err == nil {
+			received <- struct{}{}
+		}
+	})
+	// TODO: How to do this without a sleep?
+	time.Sleep(time.Second)
+
+	if err := tp.AddData(ctx, "user/300/username: hugo"); err != nil {
+		t.Fatalf("adding data: %v", err)
+	}
+
+	select {
+	case <-received:
+	case <-ctx.Done():
+		t.Fatalf("no update received")
+	}
+
+	key := dskey.MustKey("user/300/username")
+	got, err := flow.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if string(got[key]) != `"hugo"` {
+		t.Errorf("got %s, expected \"hugo\"", got[key])
+	}
+}
+
+func TestPostgresUpdateFromPosition(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	defer cancel()
+
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Postgres Test")
+	}
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	flow, err := tp.Flow()
+	if err != nil {
+		t.Fatalf("creating flow: %v", err)
+	}
+	defer flow.Close()
+
+	firstCtx, firstCancel := context.WithCancel(ctx)
+	received := make(chan struct{}, 1)
+	go flow.UpdateWithPosition(firstCtx, func(_ uint64, _ map[dskey.Key][]byte, err error) {
+		if err == nil {
+			received <- struct{}{}
+		}
+	})
+	// TODO: How to do this without a sleep?
+	time.Sleep(time.Second)
+
+	if err := tp.AddData(ctx, "user/300/username: hugo"); err != nil {
+		t.Fatalf("adding first user: %v", err)
+	}
+	<-received
+	firstCancel()
+
+	position := flow.ResumePosition()
+	if position == 0 {
+		t.Fatalf("ResumePosition() == 0 after an update")
+	}
+
+	// Changes while nobody listens.
+	if err := tp.AddData(ctx, "user/301/username: max"); err != nil {
+		t.Fatalf("adding second user: %v", err)
+	}
+
+	covered, err := flow.CoversPosition(ctx, position)
+	if err != nil {
+		t.Fatalf("CoversPosition: %v", err)
+	}
+
+	if !covered {
+		t.Fatalf("CoversPosition(%d) == false, expected true", position)
+	}
+
+	found := make(chan struct{})
+	var foundOnce sync.Once
+	key := dskey.MustKey("user/301/username")
+	go flow.UpdateFromPosition(ctx, position, func(_ uint64, data map[dskey.Key][]byte, err error) {
+		if err == nil && data[key] != nil {
+			foundOnce.Do(func() { close(found) })
+		}
+	})
+
+	select {
+	case <-found:
+	case <-ctx.Done():
+		t.Errorf("change since the position was not sent")
+	}
+}
+
+func TestRaiseLastXactIDDoesNotLower(t *testing.T) {
+	var pg datastore.FlowPostgres
+
+	pg.RaiseLastXactID(20)
+	pg.RaiseLastXactID(10)
+
+	if got := pg.LastXactID(); got != 20 {
+		t.Errorf("got last transaction id %d, expected 20", got)
+	}
+}
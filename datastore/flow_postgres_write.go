@@ -0,0 +1,470 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+	"github.com/OpenSlides/openslides-go/metagen"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// writeColumn is a column of a table, that can be written.
+type writeColumn struct {
+	// typeName is the type of the column, that is used to cast the value.
+	typeName string
+
+	// elementOID is the type of the column or the type of the elements, if the
+	// column is an array.
+	elementOID uint32
+	isArray    bool
+	generated  bool
+}
+
+// Write writes the events to postgres in one transaction.
+//
+// The events are written to the tables of the relational schema. Only fields,
+// that are columns of the table, can be written. The reverse side of a one to
+// many relation is changed by writing the field on the other side. Computed
+// fields and relations, that are saved in a separate table, like many to many
+// relations and generic relation lists, can not be written.
+//
+// The id of a created object has to be reserved with ReserveIDs of the same
+// FlowPostgres. Each reserved id can be used by one successful write.
+//
+// It returns the id of the transaction. It can be used with GetAtPosition.
+func (p *FlowPostgres) Write(ctx context.Context, events ...flow.Event) (uint64, error) {
+	if len(events) == 0 {
+		return 0, fmt.Errorf("no events to write")
+	}
+
+	tx, err := p.Pool.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadWrite})
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// Only deferrable constraints are checked at the end of the transaction.
+	// All other constraints are checked after each statement, so the events
+	// have to be in an order, that fulfills them.
+	if _, err := tx.Exec(ctx, "SET CONSTRAINTS ALL DEFERRED"); err != nil {
+		return 0, fmt.Errorf("set constraints deferred: %w", err)
+	}
+
+	created, err := p.checkReservedIDs(events)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, event := range events {
+		if err := p.writeEvent(ctx, tx, event); err != nil {
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && strings.HasPrefix(pgErr.Code, "42") {
+				// Errors of the class 42, like undefined_column or
+				// datatype_mismatch, can mean, that the schema was changed.
+				collection, _, _ := event.CollectionID()
+				p.forgetColumns(collection + "_t")
+			}
+			return 0, fmt.Errorf("%s %s: %w", event.Type, event.FQID, err)
+		}
+	}
+
+	var position uint64
+	if err := tx.QueryRow(ctx, `SELECT pg_current_xact_id()::text::bigint;`).Scan(&position); err != nil {
+		return 0, fmt.Errorf("reading transaction id: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("commit transaction: %w", err)
+	}
+	p.releaseReservedIDs(created)
+
+	// Reads from a replica have to contain the write.
+	p.raiseLastXactID(position)
+
+	return position, nil
+}
+
+// ReserveIDs returns count new ids of the collection. The ids are taken from
+// the sequence of the table, so they are never returned again, even if the
+// objects are not created.
+func (p *FlowPostgres) ReserveIDs(ctx context.Context, collection string, count int) ([]int, error) {
+	if !dskey.ValidateCollectionField(collection, "id") {
+		return nil, fmt.Errorf("unknown collection %s", collection)
+	}
+
+	if count <= 0 {
+		return nil, fmt.Errorf("invalid count %d", count)
+	}
+
+	sql := `SELECT nextval(pg_get_serial_sequence($1, 'id'))::int FROM generate_series(1, $2);`
+	rows, err := p.Pool.Query(ctx, sql, collection+"_t", count)
+	if err != nil {
+		return nil, fmt.Errorf("reserving ids of %s: %w", collection, err)
+	}
+
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, fmt.Errorf("reserving ids of %s: %w", collection, err)
+	}
+
+	p.reservedMu.Lock()
+	defer p.reservedMu.Unlock()
+
+	if p.reserved == nil {
+		p.reserved = make(map[string]map[int]struct{})
+	}
+	if p.reserved[collection] == nil {
+		p.reserved[collection] = make(map[int]struct{}, len(ids))
+	}
+	for _, id := range ids {
+		p.reserved[collection][id] = struct{}{}
+	}
+
+	return ids, nil
+}
+
+// checkReservedIDs returns an error, if an event creates an object with an id,
+// that was not reserved with ReserveIDs or is created twice. It returns the
+// created objects by collection.
+//
+// The ids stay reserved until releaseReservedIDs is called after the commit.
+// So a failed write can be repeated.
+func (p *FlowPostgres) checkReservedIDs(events []flow.Event) (map[string][]int, error) {
+	p.reservedMu.Lock()
+	defer p.reservedMu.Unlock()
+
+	created := make(map[string][]int)
+	for _, event := range events {
+		if event.Type != flow.EventCreate {
+			continue
+		}
+
+		collection, id, err := event.CollectionID()
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", event.Type, event.FQID, err)
+		}
+
+		if _, ok := p.reserved[collection][id]; !ok {
+			return nil, fmt.Errorf("%s %s: id was not reserved", event.Type, event.FQID)
+		}
+
+		if slices.Contains(created[collection], id) {
+			return nil, fmt.Errorf("%s %s: object is created twice", event.Type, event.FQID)
+		}
+		created[collection] = append(created[collection], id)
+	}
+	return created, nil
+}
+
+// releaseReservedIDs removes the ids of created objects from the reserved ids.
+func (p *FlowPostgres) releaseReservedIDs(created map[string][]int) {
+	p.reservedMu.Lock()
+	defer p.reservedMu.Unlock()
+
+	for collection, ids := range created {
+		for _, id := range ids {
+			delete(p.reserved[collection], id)
+		}
+	}
+}
+
+func (p *FlowPostgres) writeEvent(ctx context.Context, tx pgx.Tx, event flow.Event) error {
+	collection, id, err := event.CollectionID()
+	if err != nil {
+		return err
+	}
+	table := collection + "_t"
+
+	switch event.Type {
+	case flow.EventCreate, flow.EventUpdate:
+		columns, err := p.writeColumns(ctx, tx, table)
+		if err != nil {
+			return fmt.Errorf("reading columns of %s: %w", table, err)
+		}
+
+		for field := range event.Fields {
+			if _, ok := columns[field]; !ok {
+				// The column could have been added after the columns were
+				// read.
+				p.forgetColumns(table)
+				columns, err = p.writeColumns(ctx, tx, table)
+				if err != nil {
+					return fmt.Errorf("reading columns of %s: %w", table, err)
+				}
+				break
+			}
+		}
+
+		fields := make([]string, 0, len(event.Fields))
+		for field := range event.Fields {
+			fields = append(fields, field)
+		}
+		slices.Sort(fields)
+
+		args := make([]any, 0, len(fields)+1)
+		placeholders := make([]string, 0, len(fields))
+		for _, field := range fields {
+			if field == "id" {
+				return fmt.Errorf("the field id can not be written")
+			}
+
+			if IsComputedField(collection + "/" + field) {
+				return fmt.Errorf("the computed field %s can not be written", field)
+			}
+
+			if isRelationTableField(collection + "/" + field) {
+				return fmt.Errorf("the field %s is saved in a relation table and can not be written", field)
+			}
+
+			column, ok := columns[field]
+			if !ok {
+				return fmt.Errorf("field %s is not a column of %s", field, table)
+			}
+
+			if column.generated {
+				return fmt.Errorf("field %s is generated", field)
+			}
+
+			value, err := toPostgresText(event.Fields[field], column)
+			if err != nil {
+				return fmt.Errorf("converting value of %s: %w", field, err)
+			}
+
+			args = append(args, value)
+			placeholders = append(placeholders, fmt.Sprintf("$%d::text::%s", len(args), column.typeName))
+		}
+		args = append(args, id)
+		idPlaceholder := fmt.Sprintf("$%d", len(args))
+
+		if event.Type == flow.EventCreate {
+			quoted := make([]string, 0, len(fields)+1)
+			for _, field := range fields {
+				quoted = append(quoted, pgx.Identifier{field}.Sanitize())
+			}
+			quoted = append(quoted, "id")
+			placeholders = append(placeholders, idPlaceholder)
+
+			sql := fmt.Sprintf(
+				`INSERT INTO %s (%s) VALUES (%s);`,
+				pgx.Identifier{table}.Sanitize(),
+				strings.Join(quoted, ", "),
+				strings.Join(placeholders, ", "),
+			)
+			if _, err := tx.Exec(ctx, sql, args...); err != nil {
+				return fmt.Errorf("insert: %w", err)
+			}
+			return nil
+		}
+
+		if len(fields) == 0 {
+			return nil
+		}
+
+		assignments := make([]string, len(fields))
+		for i, field := range fields {
+			assignments[i] = pgx.Identifier{field}.Sanitize() + " = " + placeholders[i]
+		}
+
+		sql := fmt.Sprintf(
+			`UPDATE %s SET %s WHERE id = %s;`,
+			pgx.Identifier{table}.Sanitize(),
+			strings.Join(assignments, ", "),
+			idPlaceholder,
+		)
+		return execOne(ctx, tx, sql, args...)
+
+	case flow.EventDelete:
+		sql := fmt.Sprintf(`DELETE FROM %s WHERE id = $1;`, pgx.Identifier{table}.Sanitize())
+		return execOne(ctx, tx, sql, id)
+
+	default:
+		return fmt.Errorf("unknown event type")
+	}
+}
+
+// execOne executes a statement, that has to change exactly one row.
+func execOne(ctx context.Context, tx pgx.Tx, sql string, args ...any) error {
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("object does not exist")
+	}
+	return nil
+}
+
+// isRelationTableField returns true, if the field is a many to many relation or
+// a generic relation list. Those are saved in nm_ or gm_ tables and not in a
+// column of the collection.
+func isRelationTableField(collectionField string) bool {
+	if _, ok := metagen.GenericRelationListFields[collectionField]; ok {
+		return true
+	}
+
+	other, ok := metagen.RelationListFields[collectionField]
+	if !ok {
+		return false
+	}
+
+	if _, ok := metagen.RelationListFields[other]; ok {
+		return true
+	}
+
+	_, ok = metagen.GenericRelationListFields[other]
+	return ok
+}
+
+// forgetColumns removes the columns of a table from the cache, so they are
+// read again by the next write.
+func (p *FlowPostgres) forgetColumns(table string) {
+	p.columnsMu.Lock()
+	defer p.columnsMu.Unlock()
+
+	delete(p.columns, table)
+}
+
+// writeColumns returns the columns of a table. The result is cached until the
+// columns are forgotten with forgetColumns.
+func (p *FlowPostgres) writeColumns(ctx context.Context, tx pgx.Tx, table string) (map[string]writeColumn, error) {
+	p.columnsMu.Lock()
+	columns, ok := p.columns[table]
+	p.columnsMu.Unlock()
+
+	if ok {
+		return columns, nil
+	}
+
+	sql := `SELECT a.attname, format_type(a.atttypid, a.atttypmod), COALESCE(NULLIF(t.typelem, 0), a.atttypid), t.typcategory = 'A', a.attgenerated <> ''
+	FROM pg_attribute a JOIN pg_type t ON t.oid = a.atttypid
+	WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped;`
+	rows, err := tx.Query(ctx, sql, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns = make(map[string]writeColumn)
+	for rows.Next() {
+		var name string
+		var column writeColumn
+		if err := rows.Scan(&name, &column.typeName, &column.elementOID, &column.isArray, &column.generated); err != nil {
+			return nil, err
+		}
+		columns[name] = column
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Concurrent calls can read the same table. They get the same result, so
+	// it does not matter, which one is saved.
+	p.columnsMu.Lock()
+	defer p.columnsMu.Unlock()
+
+	if p.columns == nil {
+		p.columns = make(map[string]map[string]writeColumn)
+	}
+	p.columns[table] = columns
+	return columns, nil
+}
+
+// toPostgresText converts a json value to the text representation of the
+// column type. It is the reverse of convertValue.
+//
+// The json value null and nil are converted to nil.
+func toPostgresText(value json.RawMessage, column writeColumn) (any, error) {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 || string(value) == "null" {
+		return nil, nil
+	}
+
+	if !column.isArray {
+		return scalarToPostgresText(value, column.elementOID)
+	}
+
+	var elements []json.RawMessage
+	if err := json.Unmarshal(value, &elements); err != nil {
+		return nil, fmt.Errorf("expected a list: %w", err)
+	}
+
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i, element := range elements {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		text, err := scalarToPostgresText(element, column.elementOID)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+
+		if string(bytes.TrimSpace(element)) == "null" {
+			buf.WriteString("NULL")
+			continue
+		}
+
+		buf.WriteByte('"')
+		buf.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+
+	return buf.String(), nil
+}
+
+// scalarToPostgresText converts a json value, that is not a list, to the text
+// representation of the postgres type.
+func scalarToPostgresText(value json.RawMessage, oid uint32) (string, error) {
+	value = bytes.TrimSpace(value)
+
+	switch oid {
+	case pgtype.JSONOID, pgtype.JSONBOID:
+		if !json.Valid(value) {
+			return "", fmt.Errorf("invalid json")
+		}
+		return string(value), nil
+
+	case pgtype.TimestamptzOID, pgtype.TimestampOID, pgtype.DateOID:
+		seconds, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("expected a unix timestamp: %w", err)
+		}
+
+		t := time.Unix(seconds, 0).UTC()
+		if oid == pgtype.DateOID {
+			return t.Format("2006-01-02"), nil
+		}
+		return t.Format("2006-01-02 15:04:05Z07:00"), nil
+	}
+
+	var decoded any
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return "", fmt.Errorf("invalid json: %w", err)
+	}
+
+	switch v := decoded.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, float64:
+		return string(value), nil
+	default:
+		return "", fmt.Errorf("unsupported value %s", value)
+	}
+}
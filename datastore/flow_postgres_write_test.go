@@ -0,0 +1,224 @@
+package datastore_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore"
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
+	"github.com/OpenSlides/openslides-go/datastore/pgtest"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestToPostgresText(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		value   string
+		oid     uint32
+		isArray bool
+		expect  any
+	}{
+		{"string", `"hugo"`, pgtype.VarcharOID, false, "hugo"},
+		{"int", `42`, pgtype.Int4OID, false, "42"},
+		{"bool", `true`, pgtype.BoolOID, false, "true"},
+		{"decimal", `"1.500000"`, pgtype.NumericOID, false, "1.500000"},
+		{"json", `{"a":"b"}`, pgtype.JSONBOID, false, `{"a":"b"}`},
+		{"json string", `"text"`, pgtype.JSONBOID, false, `"text"`},
+		{"timestamp", `1700000000`, pgtype.TimestamptzOID, false, "2023-11-14 22:13:20Z"},
+		{"date", `1700000000`, pgtype.DateOID, false, "2023-11-14"},
+		{"null", `null`, pgtype.VarcharOID, false, nil},
+		{"int list", `[1,2,3]`, pgtype.Int4OID, true, `{"1","2","3"}`},
+		{"string list", `["a\"b",null]`, pgtype.VarcharOID, true, `{"a\"b",NULL}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := datastore.ToPostgresText([]byte(tt.value), tt.oid, tt.isArray)
+			if err != nil {
+				t.Fatalf("ToPostgresText: %v", err)
+			}
+
+			if got != tt.expect {
+				t.Errorf("got %v, expected %v", got, tt.expect)
+			}
+		})
+	}
+
+	if _, err := datastore.ToPostgresText([]byte(`"yesterday"`), pgtype.TimestamptzOID, false); err == nil {
+		t.Errorf("invalid timestamp returned no error")
+	}
+}
+
+func TestIsRelationTableField(t *testing.T) {
+	for _, tt := range []struct {
+		field  string
+		expect bool
+	}{
+		{"user/username", false},
+		{"meeting_user/meeting_id", false},
+		{"meeting/meeting_user_ids", false},
+		{"group/meeting_user_ids", true},
+		{"meeting_user/group_ids", true},
+		{"motion/tag_ids", true},
+		{"tag/tagged_ids", true},
+	} {
+		t.Run(tt.field, func(t *testing.T) {
+			if got := datastore.IsRelationTableField(tt.field); got != tt.expect {
+				t.Errorf("got %t, expected %t", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestFlowPostgresWrite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(t.Context(), 30*time.Second)
+	defer cancel()
+
+	t.Parallel()
+	if testing.Short() {
+		t.Skip("Postgres Test")
+	}
+
+	tp, err := pgtest.NewPostgresTest(ctx)
+	if err != nil {
+		t.Fatalf("starting postgres: %v", err)
+	}
+	defer tp.Close()
+
+	pg, err := tp.Flow()
+	if err != nil {
+		t.Fatalf("creating flow: %v", err)
+	}
+	defer pg.Close()
+
+	var writer flow.Writer = pg
+
+	ids, err := writer.ReserveIDs(ctx, "user", 1)
+	if err != nil {
+		t.Fatalf("ReserveIDs: %v", err)
+	}
+
+	fqid := fmt.Sprintf("user/%d", ids[0])
+	usernameKey := dskey.MustKey(fqid + "/username")
+	firstNameKey := dskey.MustKey(fqid + "/first_name")
+
+	position, err := writer.Write(ctx, flow.Event{
+		Type: flow.EventCreate,
+		FQID: fqid,
+		Fields: map[string]json.RawMessage{
+			"username":   []byte(`"hugo"`),
+			"first_name": []byte(`"Hugo"`),
+		},
+	})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	got, err := pg.GetAtPosition(ctx, position, usernameKey, firstNameKey)
+	if err != nil {
+		t.Fatalf("GetAtPosition: %v", err)
+	}
+
+	if string(got[usernameKey]) != `"hugo"` || string(got[firstNameKey]) != `"Hugo"` {
+		t.Errorf("after create got %s and %s", got[usernameKey], got[firstNameKey])
+	}
+
+	if _, err := writer.Write(ctx, flow.Event{
+		Type:   flow.EventUpdate,
+		FQID:   fqid,
+		Fields: map[string]json.RawMessage{"first_name": nil},
+	}); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	got, err = pg.Get(ctx, firstNameKey)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if got[firstNameKey] != nil {
+		t.Errorf("after update got first_name %s, expected nil", got[firstNameKey])
+	}
+
+	t.Run("failing event rolls back the transaction", func(t *testing.T) {
+		_, err := writer.Write(ctx,
+			flow.Event{
+				Type:   flow.EventUpdate,
+				FQID:   fqid,
+				Fields: map[string]json.RawMessage{"username": []byte(`"max"`)},
+			},
+			flow.Event{
+				Type:   flow.EventUpdate,
+				FQID:   fqid,
+				Fields: map[string]json.RawMessage{"meeting_user_ids": []byte(`[1]`)},
+			},
+		)
+		if err == nil {
+			t.Fatalf("writing a calculated field returned no error")
+		}
+
+		got, err := pg.Get(ctx, usernameKey)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+
+		if string(got[usernameKey]) != `"hugo"` {
+			t.Errorf("got username %s, expected the old value", got[usernameKey])
+		}
+	})
+
+	t.Run("create with an id, that was not reserved", func(t *testing.T) {
+		if _, err := writer.Write(ctx, flow.Event{
+			Type:   flow.EventCreate,
+			FQID:   fmt.Sprintf("user/%d", ids[0]+1000),
+			Fields: map[string]json.RawMessage{"username": []byte(`"max"`)},
+		}); err == nil {
+			t.Errorf("create with an unreserved id returned no error")
+		}
+	})
+
+	t.Run("create with an id, that was already used", func(t *testing.T) {
+		if _, err := writer.Write(ctx, flow.Event{
+			Type:   flow.EventCreate,
+			FQID:   fqid,
+			Fields: map[string]json.RawMessage{"username": []byte(`"max"`)},
+		}); err == nil {
+			t.Errorf("second create with a reserved id returned no error")
+		}
+	})
+
+	t.Run("many to many relation", func(t *testing.T) {
+		if _, err := writer.Write(ctx, flow.Event{
+			Type:   flow.EventUpdate,
+			FQID:   "group/1",
+			Fields: map[string]json.RawMessage{"meeting_user_ids": []byte(`[1]`)},
+		}); err == nil {
+			t.Errorf("writing a many to many relation returned no error")
+		}
+	})
+
+	t.Run("update unknown object", func(t *testing.T) {
+		if _, err := writer.Write(ctx, flow.Event{
+			Type:   flow.EventUpdate,
+			FQID:   "user/404",
+			Fields: map[string]json.RawMessage{"username": []byte(`"max"`)},
+		}); err == nil {
+			t.Errorf("update of unknown object returned no error")
+		}
+	})
+
+	if _, err := writer.Write(ctx, flow.Event{Type: flow.EventDelete, FQID: fqid}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	got, err = pg.Get(ctx, usernameKey)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	if got[usernameKey] != nil {
+		t.Errorf("after delete got username %s, expected nil", got[usernameKey])
+	}
+}
@@ -25,6 +25,9 @@ var (
 const liveVotesPath = "/internal/vote/live_votes"
 
 // FlowVoteCount is a datastore flow for the poll/vote_count value.
+//
+// Use RegisterComputedField("poll/live_votes", flow) and
+// CombineComputedFields to combine it with FlowPostgres.
 type FlowVoteCount struct {
 	voteServiceURL string
 	client         *http.Client
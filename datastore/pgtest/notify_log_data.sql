@@ -0,0 +1,70 @@
+-- Extends the notify log with the values of the changed rows.
+--
+-- FlowPostgres uses the column os_notify_log_t.data, if it exists, to send
+-- updates without reading the changed rows again. The column contains the
+-- row as a json object from field names to the postgres text representation of
+-- the values. Rows that are too big are logged without data.
+
+ALTER TABLE os_notify_log_t ADD COLUMN data jsonb;
+
+CREATE OR REPLACE PROCEDURE log_field_change_with_data(
+    operation_var TEXT,
+    fqid_var TEXT,
+    fields TEXT[],
+    data_var jsonb
+) AS
+$log_field_change_with_data$
+BEGIN
+    INSERT INTO os_notify_log_t (operation, fqid, xact_id, timestamp, updated_fields, data)
+    VALUES (operation_var, fqid_var, pg_current_xact_id(), now(), fields, data_var)
+    ON CONFLICT (operation, fqid, xact_id) DO UPDATE SET updated_fields = (
+        SELECT ARRAY(
+            SELECT DISTINCT e
+            FROM unnest(COALESCE(os_notify_log_t.updated_fields, '{}'::varchar[])) AS e
+            UNION
+            SELECT DISTINCT e
+            FROM unnest(COALESCE(EXCLUDED.updated_fields, '{}'::varchar[])) AS e
+        )
+    ), data = EXCLUDED.data;
+END;
+$log_field_change_with_data$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION log_modified_models() RETURNS trigger AS $log_modified_trigger$
+DECLARE
+    escaped_table_name varchar;
+    operation_var TEXT;
+    fqid_var TEXT;
+    updated_fields_var varchar(63)[];
+    old_hstore hstore;
+    new_hstore hstore;
+    data_var jsonb;
+BEGIN
+    escaped_table_name := TG_ARGV[0];
+    operation_var := LOWER(TG_OP);
+
+    -- Determine fqid (use OLD for deletes)
+    fqid_var := escaped_table_name || '/' || NEW.id;
+    IF (TG_OP = 'DELETE') THEN
+        fqid_var := escaped_table_name || '/' || OLD.id;
+    END IF;
+
+    updated_fields_var := NULL;
+    IF (TG_OP = 'UPDATE') THEN
+        old_hstore := hstore(OLD);
+        new_hstore := hstore(NEW);
+        updated_fields_var := akeys((new_hstore - old_hstore) || (old_hstore - new_hstore));
+    END IF;
+
+    data_var := NULL;
+    IF (TG_OP <> 'DELETE') THEN
+        data_var := hstore_to_jsonb(hstore(NEW));
+        IF octet_length(data_var::text) > 8000 THEN
+            data_var := NULL;
+        END IF;
+    END IF;
+
+    CALL log_field_change_with_data(operation_var, fqid_var, updated_fields_var, data_var);
+
+    RETURN NULL;  -- AFTER TRIGGER needs no return
+END;
+$log_modified_trigger$ LANGUAGE plpgsql;
@@ -30,6 +30,9 @@ var schemaSQL string
 //go:embed sql/base_data.sql
 var baseDataSQL string
 
+//go:embed notify_log_data.sql
+var notifyLogDataSQL string
+
 // PostgresTest is a test helper for postgres.
 //
 // It creates a postgres instance in a docker container. Can be used with
@@ -173,6 +176,24 @@ func (tp *PostgresTest) AddData(ctx context.Context, data string) error {
 	return nil
 }
 
+// EnableNotifyLogData extends the notify log, so that it contains the values of
+// the changed rows.
+//
+// This has to be called again after Cleanup.
+func (tp *PostgresTest) EnableNotifyLogData(ctx context.Context) error {
+	conn, err := tp.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("open connection: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, notifyLogDataSQL); err != nil {
+		return fmt.Errorf("extending notify log: %w", PrityPostgresError(err, notifyLogDataSQL))
+	}
+
+	return nil
+}
+
 // Flow returns a flow that is using the postgres instance.
 func (tp *PostgresTest) Flow() (*datastore.FlowPostgres, error) {
 	flow, err := datastore.NewFlowPostgres(environment.ForTests(tp.Env))
@@ -1,6 +1,7 @@
 package oslog
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -81,6 +82,34 @@ func Metric(metric json.RawMessage) {
 	log.Info().RawJSON("metric", metric).Msg("")
 }
 
+// MetricJSON encodes a metric for Metric. The value has to be encoded as a json
+// object. The name is added to it as field `name`.
+func MetricJSON(name string, value any) (json.RawMessage, error) {
+	encodedName, err := json.Marshal(name)
+	if err != nil {
+		return nil, fmt.Errorf("encoding name: %w", err)
+	}
+
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("encoding metric %s: %w", name, err)
+	}
+
+	fields, ok := bytes.CutPrefix(encodedValue, []byte("{"))
+	if !ok {
+		return nil, fmt.Errorf("metric %s is not a json object", name)
+	}
+
+	metric := make([]byte, 0, len(encodedName)+len(encodedValue)+9)
+	metric = append(metric, `{"name":`...)
+	metric = append(metric, encodedName...)
+	if !bytes.Equal(fields, []byte("}")) {
+		metric = append(metric, ',')
+	}
+	metric = append(metric, fields...)
+	return metric, nil
+}
+
 func msg(e *zerolog.Event, format string, a ...any) {
 	if isDev {
 		e.Msgf(format, a...)
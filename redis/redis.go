@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/datastore/flow"
 	"github.com/OpenSlides/openslides-go/environment"
 	"github.com/gomodule/redigo/redis"
 )
@@ -80,13 +81,16 @@ func (r *Redis) Wait(ctx context.Context) error {
 func (r *Redis) Update(ctx context.Context, updateFn func(map[dskey.Key][]byte, error)) {
 	id := "$"
 
+	var failures int
 	for ctx.Err() == nil {
 		newID, data, err := r.singleUpdate(ctx, id)
 		if err != nil {
 			updateFn(nil, err)
-			time.Sleep(5 * time.Second)
+			failures++
+			flow.DefaultBackoff.Wait(ctx, failures)
 			continue
 		}
+		failures = 0
 		updateFn(data, nil)
 		id = newID
 	}
@@ -0,0 +1,167 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/environment"
+	"github.com/gomodule/redigo/redis"
+)
+
+// sharedCachePrefix is the prefix of all redis keys of the shared cache.
+const sharedCachePrefix = "datastore-cache:"
+
+var envSharedCacheTTL = environment.NewVariable("CACHE_REDIS_TTL", "1h", "Duration after which a value in the shared redis cache expires.")
+
+// SharedCache stores datastore values in redis. It can be used as second level
+// cache by many instances of a service.
+//
+// Each datastore key is saved as its own redis key. A value, that does not
+// exist in the datastore, is saved as an empty string.
+type SharedCache struct {
+	r   *Redis
+	ttl time.Duration
+}
+
+// NewSharedCache initializes a SharedCache. It uses the connection pool of
+// the given Redis instance.
+func NewSharedCache(r *Redis, lookup environment.Environmenter) (*SharedCache, error) {
+	ttl, err := environment.ParseDuration(envSharedCacheTTL.Value(lookup))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", envSharedCacheTTL.Key, err)
+	}
+
+	if ttl <= 0 {
+		return nil, fmt.Errorf("%s has to be positive", envSharedCacheTTL.Key)
+	}
+
+	return &SharedCache{r: r, ttl: ttl}, nil
+}
+
+func sharedCacheKey(key dskey.Key) string {
+	return sharedCachePrefix + key.String()
+}
+
+// Get returns the values of the keys, that are in redis.
+func (s *SharedCache) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	conn := s.r.pool.Get()
+	defer conn.Close()
+
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		args[i] = sharedCacheKey(key)
+	}
+
+	values, err := redis.Values(redis.DoContext(conn, ctx, "MGET", args...))
+	if err != nil {
+		return nil, fmt.Errorf("redis MGET: %w", err)
+	}
+
+	if len(values) != len(keys) {
+		return nil, fmt.Errorf("redis MGET returned %d values for %d keys", len(values), len(keys))
+	}
+
+	data := make(map[dskey.Key][]byte, len(keys))
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+
+		bs, ok := value.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("redis MGET returned invalid value for %s: %v", keys[i], value)
+		}
+
+		if len(bs) == 0 {
+			bs = nil
+		}
+		data[keys[i]] = bs
+	}
+
+	return data, nil
+}
+
+// Set writes the values to redis.
+func (s *SharedCache) Set(ctx context.Context, data map[dskey.Key][]byte) error {
+	return s.set(ctx, data, "")
+}
+
+// SetIfMissing writes only the values of keys, that are not in redis.
+func (s *SharedCache) SetIfMissing(ctx context.Context, data map[dskey.Key][]byte) error {
+	return s.set(ctx, data, "NX")
+}
+
+// SetIfExists writes only the values of keys, that are in redis.
+func (s *SharedCache) SetIfExists(ctx context.Context, data map[dskey.Key][]byte) error {
+	return s.set(ctx, data, "XX")
+}
+
+// set writes the values with the SET command. The condition is NX, XX or
+// empty.
+func (s *SharedCache) set(ctx context.Context, data map[dskey.Key][]byte, condition string) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	conn := s.r.pool.Get()
+	defer conn.Close()
+
+	for key, value := range data {
+		args := []any{sharedCacheKey(key), value, "PX", s.ttl.Milliseconds()}
+		if condition != "" {
+			args = append(args, condition)
+		}
+
+		if err := conn.Send("SET", args...); err != nil {
+			return fmt.Errorf("redis send SET: %w", err)
+		}
+	}
+
+	replies, err := redis.Values(redis.DoContext(conn, ctx, ""))
+	if err != nil {
+		return fmt.Errorf("redis SET: %w", err)
+	}
+
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			return fmt.Errorf("redis SET: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Reset removes all values of the shared cache from redis.
+func (s *SharedCache) Reset(ctx context.Context) error {
+	conn := s.r.pool.Get()
+	defer conn.Close()
+
+	cursor := "0"
+	for {
+		reply, err := redis.Values(redis.DoContext(conn, ctx, "SCAN", cursor, "MATCH", sharedCachePrefix+"*", "COUNT", 1000))
+		if err != nil {
+			return fmt.Errorf("redis SCAN: %w", err)
+		}
+
+		var keys []any
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return fmt.Errorf("parsing redis SCAN: %w", err)
+		}
+
+		if len(keys) > 0 {
+			if _, err := redis.DoContext(conn, ctx, "UNLINK", keys...); err != nil {
+				return fmt.Errorf("redis UNLINK: %w", err)
+			}
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package redis_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/OpenSlides/openslides-go/datastore/dskey"
+	"github.com/OpenSlides/openslides-go/environment"
+	"github.com/OpenSlides/openslides-go/redis"
+)
+
+func TestSharedCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tr := newTestRedis(t)
+	defer tr.Close()
+
+	r := redis.New(environment.ForTests(tr.Env))
+	r.Wait(ctx)
+
+	sc, err := redis.NewSharedCache(r, environment.ForTests{})
+	if err != nil {
+		t.Fatalf("NewSharedCache: %v", err)
+	}
+
+	k1 := dskey.MustKey("user/1/username")
+	k2 := dskey.MustKey("user/2/username")
+	k3 := dskey.MustKey("user/3/username")
+
+	if err := sc.Set(ctx, map[dskey.Key][]byte{k1: []byte(`"hugo"`), k2: nil}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	if err := sc.SetIfMissing(ctx, map[dskey.Key][]byte{k1: []byte(`"old"`), k3: []byte(`"max"`)}); err != nil {
+		t.Fatalf("SetIfMissing: %v", err)
+	}
+
+	if err := sc.SetIfExists(ctx, map[dskey.Key][]byte{k2: []byte(`"new"`), dskey.MustKey("user/5/username"): []byte(`"unknown"`)}); err != nil {
+		t.Fatalf("SetIfExists: %v", err)
+	}
+
+	got, err := sc.Get(ctx, k1, k2, k3, dskey.MustKey("user/4/username"), dskey.MustKey("user/5/username"))
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+
+	expect := map[dskey.Key][]byte{
+		k1: []byte(`"hugo"`),
+		k2: []byte(`"new"`),
+		k3: []byte(`"max"`),
+	}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Get() == %v, expected %v", got, expect)
+	}
+
+	if err := sc.Reset(ctx); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+
+	got, err = sc.Get(ctx, k1, k2, k3)
+	if err != nil {
+		t.Fatalf("Get after reset: %v", err)
+	}
+
+	if len(got) != 0 {
+		t.Errorf("Get() after reset == %v, expected an empty map", got)
+	}
+}